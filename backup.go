@@ -0,0 +1,243 @@
+package dockage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/dgraph-io/badger"
+)
+
+//-----------------------------------------------------------------------------
+
+// A backup stream is a header, followed by records and a trailer:
+//
+//	header:  backupMagic
+//	record:  kind (1 byte), key (uvarint length, bytes), value (uvarint
+//	         length, bytes, only for recSet)
+//	trailer: recEnd, number of records (uvarint), crc32 of the records
+//	         (4 bytes), version of the backup (uvarint)
+//
+// It holds all keys of the database, documents, views, the view catalog and
+// the state of sequences, so restoring it gives the same database.
+const backupMagic = "dockage-backup-1\n"
+
+const (
+	recSet    byte = 1
+	recDelete byte = 2
+	recEnd    byte = 3
+)
+
+// Backup writes a consistent snapshot of the database to w, while it is in
+// use. With since 0, it is a full backup. Otherwise, it is an incremental one,
+// holding the keys changed or deleted after version since, which is returned
+// by a previous backup. The returned version is to be used by the next
+// incremental backup.
+func (db *DB) Backup(w io.Writer, since uint64) (resversion uint64, reserr error) {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(backupMagic); err != nil {
+		return 0, err
+	}
+	crc := crc32.NewIEEE()
+	var count uint64
+	resversion = since
+	reserr = db.view("backup", func(txn *badger.Txn) error {
+		opt := badger.DefaultIteratorOptions
+		opt.AllVersions = true
+		itr := txn.NewIterator(opt)
+		defer itr.Close()
+		var last []byte
+		for itr.Rewind(); itr.Valid(); itr.Next() {
+			item := itr.Item()
+			// only the newest version of a key counts
+			if last != nil && string(item.Key()) == string(last) {
+				continue
+			}
+			last = item.KeyCopy(last[:0])
+			if item.Version() <= since {
+				continue
+			}
+			if item.Version() > resversion {
+				resversion = item.Version()
+			}
+			if item.IsDeletedOrExpired() {
+				if since == 0 {
+					continue
+				}
+				if err := writeRecord(bw, crc, recDelete, last, nil); err != nil {
+					return err
+				}
+				count++
+				continue
+			}
+			v, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if err := writeRecord(bw, crc, recSet, last, v); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	if reserr != nil {
+		return 0, reserr
+	}
+	trailer := []byte{recEnd}
+	trailer = appendUvarint(trailer, count)
+	trailer = append(trailer, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(trailer[len(trailer)-4:], crc.Sum32())
+	trailer = appendUvarint(trailer, resversion)
+	if _, err := bw.Write(trailer); err != nil {
+		return 0, err
+	}
+	return resversion, bw.Flush()
+}
+
+func writeRecord(w io.Writer, crc hash.Hash32, kind byte, k, v []byte) error {
+	rec := appendUvarint([]byte{kind}, uint64(len(k)))
+	rec = append(rec, k...)
+	if kind == recSet {
+		rec = appendUvarint(rec, uint64(len(v)))
+		rec = append(rec, v...)
+	}
+	crc.Write(rec)
+	_, err := w.Write(rec)
+	return err
+}
+
+//-----------------------------------------------------------------------------
+
+// Restore creates a database from backups, in the directories of opt, that
+// must be empty or not exist, and opens it. r is a full backup, optionally
+// followed by incremental ones, in order (see io.MultiReader). Each backup
+// is checked against the number of records and the checksum in its trailer.
+// With opt.InMemory, it is restored into a new in-memory database.
+func Restore(r io.Reader, opt Options) (resdb *DB, reserr error) {
+	if opt.InMemory {
+		return openInMemory(opt, func(opt Options) (*DB, error) { return Restore(r, opt) })
+	}
+	for _, dir := range []string{opt.Dir, opt.ValueDir} {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if len(files) > 0 {
+			return nil, fmt.Errorf("%w: %s", ErrDirNotEmpty, dir)
+		}
+	}
+	bdb, err := openBadger(opt)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(r)
+	for n := 0; ; n++ {
+		if _, err := br.Peek(1); err == io.EOF && n > 0 {
+			break
+		}
+		if err := loadBackup(bdb, br); err != nil {
+			bdb.Close()
+			clearDirs(opt.Dir, opt.ValueDir)
+			return nil, err
+		}
+	}
+	if err := bdb.Close(); err != nil {
+		return nil, err
+	}
+	return Open(opt)
+}
+
+// clearDirs removes what a failed restore left in dirs, that were empty.
+func clearDirs(dirs ...string) {
+	for _, dir := range dirs {
+		files, _ := ioutil.ReadDir(dir)
+		for _, f := range files {
+			os.RemoveAll(filepath.Join(dir, f.Name()))
+		}
+	}
+}
+
+// loadBackup loads one backup stream from r.
+func loadBackup(bdb *badger.DB, r *bufio.Reader) error {
+	magic := make([]byte, len(backupMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != backupMagic {
+		return fmt.Errorf("%w: bad header", ErrInvalidBackup)
+	}
+	crc := crc32.NewIEEE()
+	var count uint64
+	var ops []kvop
+	for {
+		kind, err := r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+		}
+		if kind == recEnd {
+			break
+		}
+		if kind != recSet && kind != recDelete {
+			return fmt.Errorf("%w: bad record", ErrInvalidBackup)
+		}
+		rec := []byte{kind}
+		k, err := readBytes(r, &rec)
+		if err != nil {
+			return err
+		}
+		op := kvop{key: k, del: kind == recDelete}
+		if kind == recSet {
+			if op.val, err = readBytes(r, &rec); err != nil {
+				return err
+			}
+		}
+		crc.Write(rec)
+		count++
+		ops = append(ops, op)
+		if len(ops) >= 1000 {
+			if err := applyOps(bdb, ops); err != nil {
+				return err
+			}
+			ops = ops[:0]
+		}
+	}
+	wantCount, err := binary.ReadUvarint(r)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+	var wantCRC [4]byte
+	if _, err := io.ReadFull(r, wantCRC[:]); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+	if _, err := binary.ReadUvarint(r); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+	if wantCount != count || binary.BigEndian.Uint32(wantCRC[:]) != crc.Sum32() {
+		return fmt.Errorf("%w: %d records, checksum does not match", ErrInvalidBackup, count)
+	}
+	return applyOps(bdb, ops)
+}
+
+// readBytes reads a uvarint length and that many bytes, adding all to rec.
+func readBytes(r *bufio.Reader, rec *[]byte) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+	if size > math.MaxInt32 {
+		return nil, fmt.Errorf("%w: record too big", ErrInvalidBackup)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+	*rec = append(appendUvarint(*rec, size), b...)
+	return b, nil
+}
+
+//-----------------------------------------------------------------------------
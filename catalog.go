@@ -0,0 +1,233 @@
+package dockage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+
+	"github.com/dgraph-io/badger"
+)
+
+//-----------------------------------------------------------------------------
+
+// The view catalog maps view names to small numeric ids, that are used as
+// the namespace of views inside the view space:
+//
+//	.view.NAME  -> ID (4 bytes, big endian)
+//	.view_next_id -> next ID to assign
+//
+// ID 0 is reserved for the internal sequence view.
+const (
+	nssize      = 4
+	catalogview = "view"
+	catalognext = "view_next_id"
+)
+
+// sqNS is the namespace of the internal sequence view.
+var sqNS = encodeNS(0)
+
+func encodeNS(id uint32) string {
+	var buf [nssize]byte
+	binary.BigEndian.PutUint32(buf[:], id)
+	return string(buf[:])
+}
+
+func catalogKey(name string) []byte { return []byte(pat4Sys(catalogview, name)) }
+
+// lookupNS finds the namespace of a view in the catalog.
+func lookupNS(txn *badger.Txn, name string) (resns string, found bool, reserr error) {
+	item, err := txn.Get(catalogKey(name))
+	if err == badger.ErrKeyNotFound {
+		return
+	}
+	if err != nil {
+		reserr = err
+		return
+	}
+	v, err := item.ValueCopy(nil)
+	if err != nil {
+		reserr = err
+		return
+	}
+	return string(v), true, nil
+}
+
+// viewNS returns the namespace of a view, registered or not.
+func (db *DB) viewNS(txn *badger.Txn, name string) (resns string, found bool, reserr error) {
+	if v, ok := db.views.find(name); ok {
+		return v.ns, true, nil
+	}
+	return lookupNS(txn, name)
+}
+
+// registerView finds the namespace of a view in the catalog, or assigns a new
+// one. A view migrated from key format 1, under a placeholder name, gets
+// its name.
+func registerView(bdb *badger.DB, name string) (resns string, reserr error) {
+	reserr = bdb.Update(func(txn *badger.Txn) error {
+		ns, found, err := lookupNS(txn, name)
+		if err != nil {
+			return err
+		}
+		if found {
+			resns = ns
+			return nil
+		}
+		unnamed := unnamedView(string(fnvhash([]byte(name))))
+		ns, found, err = lookupNS(txn, unnamed)
+		if err != nil {
+			return err
+		}
+		if found {
+			resns = ns
+			if err := txn.Delete(catalogKey(unnamed)); err != nil {
+				return err
+			}
+			return txn.Set(catalogKey(name), []byte(resns))
+		}
+		next, err := nextNSID(txn)
+		if err != nil {
+			return err
+		}
+		resns = encodeNS(next)
+		if err := txn.Set(catalogKey(name), []byte(resns)); err != nil {
+			return err
+		}
+		return txn.Set([]byte(pat4Sys(catalognext)), []byte(encodeNS(next+1)))
+	})
+	return
+}
+
+// nextNSID returns the next id to assign in the catalog.
+func nextNSID(txn *badger.Txn) (uint32, error) {
+	item, err := txn.Get([]byte(pat4Sys(catalognext)))
+	if err == badger.ErrKeyNotFound {
+		return 1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	v, err := item.ValueCopy(nil)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(v), nil
+}
+
+// unnamedView is the placeholder name, in the catalog, of a view migrated
+// from key format 1, where only the hash of its name is known: # and the hex
+// of the hash. It is renamed when the view is added.
+func unnamedView(hash string) string { return "#" + hex.EncodeToString([]byte(hash)) }
+
+//-----------------------------------------------------------------------------
+
+// ViewInfo describes the data of a view inside the database.
+type ViewInfo struct {
+	Name string
+	ID   uint32
+	// Registered is true if the view is added, using AddView(...), since the
+	// database is opened. Data of views that are not registered is not
+	// updated anymore; it can be deleted by DeleteOrphanViews().
+	Registered bool
+	// Entries is the number of emitted view keys.
+	Entries int
+	// Size is the size, in bytes, of the keys of the entries of the view,
+	// the same as ViewStats.Size; emitted values, and other data a view may
+	// keep, like text stats or a vector graph, are not counted.
+	Size int64
+}
+
+// Views lists the views in the catalog, registered or orphaned, with
+// the number of their entries and their size, as reported by Stats().
+func (db *DB) Views() (reslist []ViewInfo, reserr error) {
+	reserr = db.view("views", func(txn *badger.Txn) error {
+		opt := badger.DefaultIteratorOptions
+		opt.PrefetchValues = false
+		prefix := catalogKey("")
+		var infos []ViewInfo
+		err := itrFunc(txn, opt, prefix, prefix, func(itr interface{ Item() *badger.Item }) error {
+			item := itr.Item()
+			v, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			name := string(bytes.TrimPrefix(item.Key(), prefix))
+			_, registered := db.views.find(name)
+			infos = append(infos, ViewInfo{
+				Name:       name,
+				ID:         binary.BigEndian.Uint32(v),
+				Registered: registered,
+			})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		counts, _, err := readCounts(txn, 0)
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			ns := encodeNS(info.ID)
+			c, ok := counts[ns]
+			if !ok {
+				// an orphaned view, built before counters were kept
+				if c, err = scanCounts(txn, ns); err != nil {
+					return err
+				}
+			}
+			info.Entries, info.Size = int(c.entries), c.size
+			reslist = append(reslist, info)
+		}
+		return nil
+	})
+	return
+}
+
+// DeleteOrphanViews deletes the data of views that are in the catalog but
+// not registered.
+func (db *DB) DeleteOrphanViews() (reserr error) {
+	infos, err := db.Views()
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.Registered {
+			continue
+		}
+		ops, err := db.prefixDeletes([]byte(pat4View(encodeNS(info.ID))))
+		if err != nil {
+			return err
+		}
+		ops = append(ops, kvop{key: catalogKey(info.Name), del: true})
+		if err := applyOps(db.db, ops); err != nil {
+			return err
+		}
+		err = db.update("delete_orphan_views", func(txn *badger.Txn) error {
+			tx := newTransaction(context.Background(), txn, db.obs)
+			if err := db.resetCounts(tx, encodeNS(info.ID)); err != nil {
+				return err
+			}
+			return db.writeCounts(tx)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return
+}
+
+func (db *DB) prefixDeletes(prefix []byte) (resops []kvop, reserr error) {
+	reserr = db.view("delete_orphan_views", func(txn *badger.Txn) error {
+		opt := badger.DefaultIteratorOptions
+		opt.PrefetchValues = false
+		return itrFunc(txn, opt, prefix, prefix, func(itr interface{ Item() *badger.Item }) error {
+			resops = append(resops, kvop{key: itr.Item().KeyCopy(nil), del: true})
+			return nil
+		})
+	})
+	return
+}
+
+//-----------------------------------------------------------------------------
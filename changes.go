@@ -0,0 +1,106 @@
+package dockage
+
+import (
+	"github.com/dgraph-io/badger"
+)
+
+//-----------------------------------------------------------------------------
+
+// Change is a change of a document, found by Changes(...). Seq is the rev
+// the document got by the change; for a deletion, a new rev given to it.
+type Change struct {
+	Seq     string
+	ID      string
+	Deleted bool
+}
+
+// Changes lists the changes after since, the Seq of a previous change or
+// empty for all, in the order they were made, up to limit (default 100).
+// A document is listed once, at its last change; a deleted document is
+// listed with Deleted set, until it is put again. It reads the internal view
+// of revs, so it costs no more than a view query.
+func (db *DB) Changes(since string, limit int) (reslist []Change, reserr error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	prefix := []byte(pat4View(sqNS + viewx2k))
+	start := prefix
+	if since != "" {
+		start = appendSegment(prefix[:len(prefix):len(prefix)], []byte(since))
+	}
+	reserr = db.view("changes", func(txn *badger.Txn) error {
+		opt := badger.DefaultIteratorOptions
+		opt.PrefetchValues = false
+		return itrFunc(txn, opt, start, prefix, func(itr interface{ Item() *badger.Item }) error {
+			seq, id := splitViewKey(itr.Item().Key())
+			if seq == nil || string(seq) == since {
+				return nil
+			}
+			if len(reslist) == limit {
+				return errStop
+			}
+			deleted, err := isTombstone(itr.Item())
+			if err != nil {
+				return err
+			}
+			reslist = append(reslist, Change{Seq: string(seq), ID: string(id), Deleted: deleted})
+			return nil
+		})
+	})
+	return
+}
+
+//-----------------------------------------------------------------------------
+
+// A deleted document leaves a tombstone in the sequence view, with a new
+// rev, so Changes(...) reports the deletion:
+//
+//	^NS[ REV ID -> tombstone
+//	^NS~ID      -> the key above
+//
+// Tombstones are not counted as documents. A tombstone is removed when
+// the document is put again.
+var tombstone = []byte("deleted")
+
+func tombstoneKey(id string) []byte { return []byte(pat4View(sqNS+viewdel) + id) }
+
+// isTombstone tells if item, of the sequence view, is a tombstone; other
+// entries of the sequence view have no value.
+func isTombstone(item *badger.Item) (bool, error) {
+	v, err := item.ValueCopy(nil)
+	return len(v) > 0, err
+}
+
+// addTombstone records the deletion of document id.
+func (db *DB) addTombstone(txn *badger.Txn, id string) error {
+	rev, err := db.nextRev()
+	if err != nil {
+		return err
+	}
+	x2k := append(appendSegment([]byte(pat4View(sqNS+viewx2k)), rev), id...)
+	if err := txn.Set(x2k, tombstone); err != nil {
+		return err
+	}
+	return txn.Set(tombstoneKey(id), x2k)
+}
+
+// clearTombstone removes the tombstone of document id, if there is one.
+func clearTombstone(txn *badger.Txn, id string) error {
+	item, err := txn.Get(tombstoneKey(id))
+	if err == badger.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	x2k, err := item.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+	if err := txn.Delete(x2k); err != nil {
+		return err
+	}
+	return txn.Delete(tombstoneKey(id))
+}
+
+//-----------------------------------------------------------------------------
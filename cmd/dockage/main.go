@@ -0,0 +1,333 @@
+// Command dockage inspects and edits a dockage database.
+//
+//	dockage -dir DIR [-valuedir DIR] [-w [-force]] COMMAND [ARGS]
+//
+// The database is opened read-only, unless -w is given. Commands:
+//
+//	get ID...          print documents, one json per line
+//	put                store json documents read from stdin
+//	delete ID...       delete documents
+//	query [FLAGS]      query ids, or a view with -view
+//	views              list the view catalog, with entries and sizes
+//	export [-prefix P] write documents as NDJSON to stdout
+//	import [FLAGS]     read NDJSON documents from stdin
+//	stats              print counts of documents, views and storage sizes
+//	raw [FLAGS] [SPACE] dump raw keys and values of a key space: & documents,
+//	                   ^ views, . system keys, or all
+//
+// Documents are written as json, without their Go types, so views are not
+// updated by put, delete and import; the functions of views live in the
+// application. These commands refuse to write to a database with views,
+// unless -force is given; views can then be rebuilt by the application,
+// with RebuildView. Documents must have "id" and "rev" json fields.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/dc0d/dockage"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "dockage:", err)
+		os.Exit(1)
+	}
+}
+
+var errUsage = errors.New("usage: dockage -dir DIR [-valuedir DIR] [-w [-force]] get|put|delete|query|views|export|import|stats|raw [ARGS]")
+
+type command struct {
+	write bool
+	run   func(db *dockage.DB, args []string, in io.Reader, out io.Writer) error
+}
+
+var commands = map[string]command{
+	"get":    {run: get},
+	"put":    {write: true, run: put},
+	"delete": {write: true, run: del},
+	"query":  {run: query},
+	"views":  {run: views},
+	"export": {run: export},
+	"import": {write: true, run: importDocs},
+	"stats":  {run: stats},
+	"raw":    {run: raw},
+}
+
+func run(args []string, in io.Reader, out io.Writer) (reserr error) {
+	fs := flag.NewFlagSet("dockage", flag.ContinueOnError)
+	dir := fs.String("dir", "", "directory of the database")
+	valueDir := fs.String("valuedir", "", "directory of the value log, default -dir")
+	write := fs.Bool("w", false, "open the database for writing")
+	force := fs.Bool("force", false, "write even if views are not updated")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *dir == "" || fs.NArg() == 0 {
+		return errUsage
+	}
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok {
+		return fmt.Errorf("unknown command %q\n%v", fs.Arg(0), errUsage)
+	}
+	if cmd.write && !*write {
+		return fmt.Errorf("%s writes to the database, it needs -w", fs.Arg(0))
+	}
+	if *valueDir == "" {
+		*valueDir = *dir
+	}
+	db, err := dockage.Open(dockage.Options{Dir: *dir, ValueDir: *valueDir, ReadOnly: !*write})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := db.Close(); err != nil && reserr == nil {
+			reserr = err
+		}
+	}()
+	if cmd.write && !*force {
+		if err := checkNoViews(db, fs.Arg(0)); err != nil {
+			return err
+		}
+	}
+	bw := bufio.NewWriter(out)
+	if err := cmd.run(db, fs.Args()[1:], in, bw); err != nil {
+		bw.Flush()
+		return err
+	}
+	return bw.Flush()
+}
+
+// checkNoViews fails if the database has views, that a write by command cmd
+// would leave stale.
+func checkNoViews(db *dockage.DB, cmd string) error {
+	infos, err := db.Views()
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s would not update views %s: write through the application, "+
+		"or use -force and rebuild them with RebuildView", cmd, strings.Join(names, ", "))
+}
+
+//-----------------------------------------------------------------------------
+
+func get(db *dockage.DB, args []string, in io.Reader, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("usage: get ID...")
+	}
+	list, err := db.GetMany(args, dockage.GetOptions{})
+	if err != nil {
+		return err
+	}
+	var missing []string
+	for _, r := range list {
+		if !r.Found() {
+			missing = append(missing, r.ID)
+			continue
+		}
+		fmt.Fprintf(out, "%s\n", r.Doc)
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %s", dockage.ErrNotFound, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// put stores all documents of in, json objects one after the other, in one
+// transaction. A new document has an empty rev; an existing one must have its
+// current rev.
+func put(db *dockage.DB, args []string, in io.Reader, out io.Writer) error {
+	dec := json.NewDecoder(in)
+	var docs []interface{}
+	for {
+		d := new(dockage.RawDoc)
+		err := dec.Decode(d)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("document %d: %v", len(docs)+1, err)
+		}
+		docs = append(docs, d)
+	}
+	if err := db.Put(docs...); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(out)
+	for _, d := range docs {
+		d := d.(*dockage.RawDoc)
+		if err := enc.Encode(map[string]string{"id": d.ID, "rev": d.Rev}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func del(db *dockage.DB, args []string, in io.Reader, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("usage: delete ID...")
+	}
+	return db.Delete(args...)
+}
+
+//-----------------------------------------------------------------------------
+
+func query(db *dockage.DB, args []string, in io.Reader, out io.Writer) error {
+	fs := flag.NewFlagSet("query", flag.ContinueOnError)
+	view := fs.String("view", "", "name of the view, ids if empty")
+	start := fs.String("start", "", "first key")
+	end := fs.String("end", "", "last key")
+	prefix := fs.String("prefix", "", "prefix of keys")
+	skip := fs.Int("skip", 0, "number of results to skip")
+	limit := fs.Int("limit", 100, "number of results")
+	count := fs.Bool("count", false, "print only the number of results")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	q := dockage.Q{View: *view, Skip: *skip, Limit: *limit, Count: *count}
+	for _, v := range []struct {
+		s string
+		p *[]byte
+	}{{*start, &q.Start}, {*end, &q.End}, {*prefix, &q.Prefix}} {
+		if v.s != "" {
+			*v.p = []byte(v.s)
+		}
+	}
+	list, n, err := db.Query(q)
+	if err != nil {
+		return err
+	}
+	if *count {
+		_, err := fmt.Fprintln(out, n)
+		return err
+	}
+	enc := json.NewEncoder(out)
+	for _, r := range list {
+		if *view == "" {
+			fmt.Fprintf(out, "%s\n", r.Val)
+			continue
+		}
+		line := map[string]string{"id": string(r.Key), "key": string(r.Index), "value": string(r.Val)}
+		if err := enc.Encode(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func views(db *dockage.DB, args []string, in io.Reader, out io.Writer) error {
+	infos, err := db.Views()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%-24s %6s %10s %12s\n", "NAME", "ID", "ENTRIES", "BYTES")
+	for _, info := range infos {
+		fmt.Fprintf(out, "%-24s %6d %10d %12d\n", info.Name, info.ID, info.Entries, info.Size)
+	}
+	return nil
+}
+
+func stats(db *dockage.DB, args []string, in io.Reader, out io.Writer) error {
+	st, err := db.Stats()
+	if err != nil {
+		return err
+	}
+	var names []string
+	for name := range st.Views {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(out, "documents\t%d\n", st.Docs)
+	fmt.Fprintf(out, "seq\t%s\n", st.Seq)
+	fmt.Fprintf(out, "lsm bytes\t%d\n", st.LSMSize)
+	fmt.Fprintf(out, "vlog bytes\t%d\n", st.VlogSize)
+	for _, name := range names {
+		v := st.Views[name]
+		fmt.Fprintf(out, "view %s\t%d entries, %d bytes\n", name, v.Entries, v.Size)
+	}
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+
+func export(db *dockage.DB, args []string, in io.Reader, out io.Writer) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	prefix := fs.String("prefix", "", "prefix of ids")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	_, err := db.Export(out, dockage.ExportFilter{Prefix: *prefix})
+	return err
+}
+
+var revModes = map[string]dockage.RevMode{
+	"keep":       dockage.RevKeep,
+	"regenerate": dockage.RevRegenerate,
+	"skip":       dockage.RevSkipExisting,
+}
+
+func importDocs(db *dockage.DB, args []string, in io.Reader, out io.Writer) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	revs := fs.String("revs", "keep", "keep, regenerate or skip (existing documents)")
+	batch := fs.Int("batch", 100, "documents per transaction")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	mode, ok := revModes[*revs]
+	if !ok {
+		return fmt.Errorf("unknown -revs %q", *revs)
+	}
+	imported, skipped, err := db.Import(in, dockage.ImportOptions{Revs: mode, BatchSize: *batch})
+	fmt.Fprintf(out, "imported %d, skipped %d\n", imported, skipped)
+	return err
+}
+
+var spaces = map[string]string{"&": "&", "^": "^", ".": ".", "all": ""}
+
+func raw(db *dockage.DB, args []string, in io.Reader, out io.Writer) error {
+	fs := flag.NewFlagSet("raw", flag.ContinueOnError)
+	prefix := fs.String("prefix", "", "prefix of keys, inside the space")
+	limit := fs.Int("limit", 0, "number of keys, all if 0")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	space := "all"
+	if fs.NArg() > 0 {
+		space = fs.Arg(0)
+	}
+	sp, ok := spaces[space]
+	if !ok {
+		return fmt.Errorf("unknown space %q, one of &, ^, . or all", space)
+	}
+	errLimit := errors.New("limit")
+	n := 0
+	err := db.Dump([]byte(sp+*prefix), func(kv dockage.KV) error {
+		if *limit > 0 && n == *limit {
+			return errLimit
+		}
+		n++
+		_, err := fmt.Fprintf(out, "%q\t%q\n", kv.Key, kv.Val)
+		return err
+	})
+	if err == errLimit {
+		return nil
+	}
+	return err
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/dc0d/dockage"
+	"github.com/stretchr/testify/require"
+)
+
+type post struct {
+	ID   string   `json:"id"`
+	Rev  string   `json:"rev"`
+	Tags []string `json:"tags,omitempty"`
+}
+
+func createDB(t *testing.T) string {
+	dir, err := ioutil.TempDir(os.TempDir(), "cmd")
+	require.NoError(t, err)
+	db, err := dockage.Open(dockage.Options{Dir: dir, ValueDir: dir})
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.AddView(dockage.NewView("tags",
+		func(em dockage.Emitter, id string, doc interface{}) {
+			if p, ok := doc.(*post); ok {
+				for _, v := range p.Tags {
+					em.Emit([]byte(v), []byte("1"))
+				}
+			}
+		})))
+	require.NoError(t, db.Put(
+		&post{ID: "P1", Tags: []string{"go"}},
+		&post{ID: "P2", Tags: []string{"db", "go"}}))
+	return dir
+}
+
+func dockageCmd(dir string, stdin string, args ...string) (string, error) {
+	var out bytes.Buffer
+	err := run(append([]string{"-dir", dir}, args...), strings.NewReader(stdin), &out)
+	return out.String(), err
+}
+
+func TestCommands(t *testing.T) {
+	require := require.New(t)
+	dir := createDB(t)
+
+	out, err := dockageCmd(dir, "", "get", "P1")
+	require.NoError(err)
+	require.Contains(out, `"id":"P1"`)
+	_, err = dockageCmd(dir, "", "get", "P1", "P9")
+	require.True(errors.Is(err, dockage.ErrNotFound))
+
+	out, err = dockageCmd(dir, "", "query", "-view", "tags", "-prefix", "go")
+	require.NoError(err)
+	require.Equal(2, strings.Count(out, "\n"))
+	require.Contains(out, `{"id":"P1","key":"go","value":"1"}`)
+	out, err = dockageCmd(dir, "", "query", "-count")
+	require.NoError(err)
+	require.Equal("2\n", out)
+
+	out, err = dockageCmd(dir, "", "views")
+	require.NoError(err)
+	require.Contains(out, "tags")
+
+	out, err = dockageCmd(dir, "", "stats")
+	require.NoError(err)
+	require.Contains(out, "documents\t2\n")
+	require.Contains(out, "view tags\t3 entries")
+
+	out, err = dockageCmd(dir, "", "raw", "-limit", "1", "&")
+	require.NoError(err)
+	require.True(strings.HasPrefix(out, `"&P1"`))
+	_, err = dockageCmd(dir, "", "raw", "?")
+	require.Error(err)
+
+	// writes need -w
+	_, err = dockageCmd(dir, `{"id":"P3"}`, "put")
+	require.Error(err)
+	// and -force, with views that would not be updated
+	for _, args := range [][]string{{"put"}, {"delete", "P1"}, {"import"}} {
+		_, err = dockageCmd(dir, "", append([]string{"-w"}, args...)...)
+		require.Error(err)
+		require.Contains(err.Error(), "RebuildView")
+	}
+	out, err = dockageCmd(dir, `{"id":"P3","title":"new"} {"id":"P4"}`, "-w", "-force", "put")
+	require.NoError(err)
+	require.Equal(2, strings.Count(out, "\n"))
+	out, err = dockageCmd(dir, "", "get", "P3")
+	require.NoError(err)
+	require.Contains(out, `"title":"new"`)
+	_, err = dockageCmd(dir, `{"id":"P3"}`, "-w", "-force", "put")
+	require.True(errors.Is(err, dockage.ErrNoMatchRev))
+
+	_, err = dockageCmd(dir, "", "-w", "-force", "delete", "P4")
+	require.NoError(err)
+	out, err = dockageCmd(dir, "", "export")
+	require.NoError(err)
+	require.Equal(3, strings.Count(out, "\n"))
+
+	other := createDB(t)
+	imported, err := dockageCmd(other, out, "-w", "-force", "import", "-revs", "skip")
+	require.NoError(err)
+	require.Equal("imported 1, skipped 2\n", imported)
+
+	// without views, -force is not needed
+	empty, err := ioutil.TempDir(os.TempDir(), "cmd")
+	require.NoError(err)
+	_, err = dockageCmd(empty, `{"id":"P1"}`, "-w", "put")
+	require.NoError(err)
+}
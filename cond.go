@@ -0,0 +1,258 @@
+package dockage
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/dgraph-io/badger"
+)
+
+//-----------------------------------------------------------------------------
+
+// Cond is a condition on documents, that is evaluated using views. A Q is
+// a Cond, that matches the documents it finds (Skip, Limit and Count of
+// the Q are ignored). Conditions are combined using And, Or and Not.
+type Cond interface {
+	// eval returns the sorted, distinct ids of matching documents.
+	eval(db *DB, txn *badger.Txn) ([]string, error)
+}
+
+// And matches documents that match all conds. Not(...) conds are applied
+// by removing their documents.
+func And(conds ...Cond) Cond { return andCond(conds) }
+
+// Or matches documents that match any of conds.
+func Or(conds ...Cond) Cond { return orCond(conds) }
+
+// Not matches documents that do not match cond.
+func Not(cond Cond) Cond { return notCond{cond} }
+
+// CondQ are params for QueryCond(...).
+type CondQ struct {
+	// After is a cursor; only documents with ids greater than After are
+	// returned. To get the next page, set it to the Key of the last result.
+	After string
+	// Limit is the maximum number of results - default 100.
+	Limit int
+	// Count returns only the number of matching documents, after After.
+	Count bool
+}
+
+// QueryCond finds the documents that match cond, in one read transaction.
+// Results are sorted by document id; Key is the id and Val is the json of
+// the document.
+func (db *DB) QueryCond(cond Cond, params CondQ) (reslist []Res, rescount int, reserr error) {
+	if params.Limit <= 0 {
+		params.Limit = 100
+	}
+	reserr = db.view("query_cond", func(txn *badger.Txn) error {
+		ids, err := cond.eval(db, txn)
+		if err != nil {
+			return err
+		}
+		if params.After != "" {
+			ix := sort.SearchStrings(ids, params.After)
+			if ix < len(ids) && ids[ix] == params.After {
+				ix++
+			}
+			ids = ids[ix:]
+		}
+		if params.Count {
+			rescount = len(ids)
+			return nil
+		}
+		if len(ids) > params.Limit {
+			ids = ids[:params.Limit]
+		}
+		for _, id := range ids {
+			v, err := getDoc(txn, id)
+			if err != nil {
+				return err
+			}
+			reslist = append(reslist, Res{KV: KV{Key: []byte(id), Val: v}})
+		}
+		rescount = len(reslist)
+		return nil
+	})
+	return
+}
+
+//-----------------------------------------------------------------------------
+
+func (q Q) eval(db *DB, txn *badger.Txn) (resids []string, reserr error) {
+	var ns string
+	if q.View != "" {
+		var found bool
+		ns, found, reserr = db.viewNS(txn, q.View)
+		if reserr != nil || !found {
+			return
+		}
+	}
+	var end []byte
+	body := func(itr interface{ Item() *badger.Item }) error {
+		k := itr.Item().Key()
+		if len(end) > 0 && bytes.Compare(k, end) > 0 {
+			return errStop
+		}
+		if bytes.HasPrefix(k, []byte(viewsp)) {
+			_, id := splitViewKey(k)
+			resids = append(resids, string(id))
+			return nil
+		}
+		resids = append(resids, string(bytes.TrimPrefix(k, []byte(keysp))))
+		return nil
+	}
+	opt := badger.DefaultIteratorOptions
+	opt.PrefetchValues = false
+	for _, sc := range scans(q, ns) {
+		end = sc.end
+		if sc.exact {
+			item, err := txn.Get(sc.start)
+			if err == badger.ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			body(itemOf{item})
+			continue
+		}
+		if reserr = itrFunc(txn, opt, sc.start, sc.prefix, body); reserr != nil {
+			return
+		}
+	}
+	resids = sortIDs(resids)
+	return
+}
+
+type andCond []Cond
+
+func (c andCond) eval(db *DB, txn *badger.Txn) (resids []string, reserr error) {
+	var positive, negative [][]string
+	for _, sub := range c {
+		if n, ok := sub.(notCond); ok {
+			ids, err := n.cond.eval(db, txn)
+			if err != nil {
+				return nil, err
+			}
+			negative = append(negative, ids)
+			continue
+		}
+		ids, err := sub.eval(db, txn)
+		if err != nil {
+			return nil, err
+		}
+		positive = append(positive, ids)
+	}
+	if len(positive) == 0 {
+		if resids, reserr = allIDs(txn); reserr != nil {
+			return
+		}
+	} else {
+		// smaller lists first, to keep intersections small
+		sort.Slice(positive, func(i, j int) bool { return len(positive[i]) < len(positive[j]) })
+		resids = positive[0]
+		for _, ids := range positive[1:] {
+			resids = intersectIDs(resids, ids)
+		}
+	}
+	for _, ids := range negative {
+		resids = subtractIDs(resids, ids)
+	}
+	return
+}
+
+type orCond []Cond
+
+func (c orCond) eval(db *DB, txn *badger.Txn) (resids []string, reserr error) {
+	for _, sub := range c {
+		ids, err := sub.eval(db, txn)
+		if err != nil {
+			return nil, err
+		}
+		resids = unionIDs(resids, ids)
+	}
+	return
+}
+
+type notCond struct{ cond Cond }
+
+func (c notCond) eval(db *DB, txn *badger.Txn) ([]string, error) {
+	return andCond{c}.eval(db, txn)
+}
+
+// allIDs returns the ids of all documents.
+func allIDs(txn *badger.Txn) ([]string, error) {
+	return Q{}.eval(nil, txn)
+}
+
+//-----------------------------------------------------------------------------
+
+func sortIDs(ids []string) []string {
+	sort.Strings(ids)
+	if len(ids) == 0 {
+		return ids
+	}
+	res := ids[:1]
+	for _, id := range ids[1:] {
+		if id != res[len(res)-1] {
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
+// intersectIDs merges two sorted lists into the ids found in both.
+func intersectIDs(a, b []string) (res []string) {
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			res = append(res, a[i])
+			i++
+			j++
+		}
+	}
+	return
+}
+
+// unionIDs merges two sorted lists into the ids found in either.
+func unionIDs(a, b []string) (res []string) {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			res = append(res, a[i])
+			i++
+		case a[i] > b[j]:
+			res = append(res, b[j])
+			j++
+		default:
+			res = append(res, a[i])
+			i++
+			j++
+		}
+	}
+	res = append(res, a[i:]...)
+	return append(res, b[j:]...)
+}
+
+// subtractIDs merges two sorted lists into the ids of a, not found in b.
+func subtractIDs(a, b []string) (res []string) {
+	j := 0
+	for _, id := range a {
+		for j < len(b) && b[j] < id {
+			j++
+		}
+		if j < len(b) && b[j] == id {
+			continue
+		}
+		res = append(res, id)
+	}
+	return
+}
+
+//-----------------------------------------------------------------------------
@@ -1,16 +1,83 @@
 package dockage
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 )
 
 // Res represents the result of a Query(...) call.
 // Key is the document key, Index is the calculated index and Val is
-// the calculated value by the view.
+// the calculated value by the view. Group is the index of the key or range,
+// in Q.Keys and Q.Ranges, that this result is found by.
 type Res struct {
 	KV
 	Index []byte
+	Group int
+}
+
+// GetRes is the result of reading one document by GetMany(...). Doc is
+// the json of the document; it is empty if Err is not nil. Err is
+// ErrNotFound if there is no document with this id.
+type GetRes struct {
+	ID  string
+	Doc []byte
+	Err error
+}
+
+// Found reports if the document was read successfully.
+func (r GetRes) Found() bool { return r.Err == nil }
+
+// Unmarshal decodes the document into v. It returns Err if the document
+// could not be read.
+func (r GetRes) Unmarshal(v interface{}) error {
+	if r.Err != nil {
+		return r.Err
+	}
+	return json.Unmarshal(r.Doc, v)
+}
+
+// RawDoc is a json object, without a Go type, to be stored by Put(...).
+// Its id and rev are read from, and written to, its "id" and "rev" fields.
+// Views get the *RawDoc itself.
+type RawDoc struct {
+	ID     string `json:"id"`
+	Rev    string `json:"rev"`
+	fields map[string]json.RawMessage
+}
+
+// Field returns the json of a field of the document, or nil.
+func (d *RawDoc) Field(name string) json.RawMessage { return d.fields[name] }
+
+// UnmarshalJSON decodes a json object.
+func (d *RawDoc) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	if fields == nil {
+		return errors.New("document must be a json object")
+	}
+	for name, p := range map[string]*string{"id": &d.ID, "rev": &d.Rev} {
+		*p = ""
+		if v, ok := fields[name]; ok && string(v) != "null" {
+			if err := json.Unmarshal(v, p); err != nil {
+				return fmt.Errorf("%s field must be a string", name)
+			}
+		}
+	}
+	d.fields = fields
+	return nil
+}
+
+// MarshalJSON encodes the document, with its current id and rev.
+func (d *RawDoc) MarshalJSON() ([]byte, error) {
+	fields := make(map[string]interface{}, len(d.fields)+2)
+	for k, v := range d.fields {
+		fields[k] = v
+	}
+	fields["id"], fields["rev"] = d.ID, d.Rev
+	return json.Marshal(fields)
 }
 
 // KV tuple.
@@ -18,33 +85,83 @@ type KV struct {
 	Key, Val []byte
 }
 
+// ConflictError is returned by Put(...) when the rev of a document does not
+// match the rev of the stored document. Rev is empty when an existing document
+// is put without a rev. It matches ErrNoMatchRev, using errors.Is.
+type ConflictError struct {
+	ID         string
+	Rev        string
+	CurrentRev string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%v: id %s rev %q current rev %q", ErrNoMatchRev, e.ID, e.Rev, e.CurrentRev)
+}
+
+// Is reports if target is ErrNoMatchRev.
+func (e *ConflictError) Is(target error) bool { return target == ErrNoMatchRev }
+
+// UniqueViolation is returned by Put(...) when a document emits a key into
+// a unique view, that is already owned by another document. It matches
+// ErrUniqueViolation, using errors.Is.
+type UniqueViolation struct {
+	View  string
+	Key   []byte
+	ID    string
+	Owner string
+}
+
+func (e *UniqueViolation) Error() string {
+	return fmt.Sprintf("%v: view %s key %q of id %s is owned by id %s",
+		ErrUniqueViolation, e.View, e.Key, e.ID, e.Owner)
+}
+
+// Is reports if target is ErrUniqueViolation.
+func (e *UniqueViolation) Is(target error) bool { return target == ErrUniqueViolation }
+
 // errors
 var (
-	ErrNoID      = errors.New("no id field in doc json")
-	ErrNoRev     = errors.New("no rev field in doc json")
-	ErrInvalidID = fmt.Errorf("id must not contain these characters: %s %s %s %s %s",
-		viewsp,
-		keysp,
-		syssp,
-		viewk2x,
-		viewx2k)
-	ErrNoMatchRev = errors.New("rev field in doc json not matching")
+	ErrNoID  = errors.New("no id field in doc json")
+	ErrNoRev = errors.New("no rev field in doc json")
+	// Deprecated: ids can contain any characters; it is not returned anymore.
+	ErrInvalidID      = errors.New("id contains invalid characters")
+	ErrNoMatchRev     = errors.New("rev field in doc json not matching")
+	ErrInvalidIDType  = errors.New("id field must be a string")
+	ErrInvalidRevType = errors.New("rev field must be a string")
+	ErrIDNotSettable  = errors.New("generated id can not be set, doc must be a pointer")
+	ErrNotFound       = errors.New("document not found")
+
+	ErrUniqueViolation = errors.New("unique view key already exists")
+
+	ErrViewNotFound       = errors.New("view not found")
+	ErrViewNotRebuildable = errors.New("view does not work on stored json and can not be rebuilt")
+
+	ErrInvalidSelector = errors.New("invalid selector")
+	ErrInvalidLocation = errors.New("invalid location")
+	ErrInvalidVector   = errors.New("invalid vector")
+
+	ErrDirNotEmpty   = errors.New("directory is not empty")
+	ErrInvalidBackup = errors.New("invalid backup")
+	ErrInvalidImport = errors.New("invalid import line")
+
+	ErrReadOnly       = errors.New("database is opened read-only")
+	ErrInvalidOptions = errors.New("invalid options")
 )
 
 const (
-	viewsp = "^" // view space - ^BUCKET^PART^PART^PART
+	viewsp = "^" // view space - ^NS DOMAIN SEGMENT SEGMENT
 	keysp  = "&" // key space
 	syssp  = "."
 
-	viewk2x = ">"
-	viewx2k = "<"
-
-	specials = viewsp +
-		keysp +
-		syssp +
-		viewk2x +
-		viewx2k
+	viewk2x = "]"
+	viewx2k = "["
+	viewk2o = "=" // unique views: view key to owner id
+	viewsts = "#" // text views: number of documents and their total length
+	viewgph = "@" // vector views: graph of the approximate index
+	viewdel = "~" // the sequence view: id of a deleted document to its tombstone
 
 	dbseq     = "db_timestamp"
 	viewdbseq = "view_db_timestamp"
+	idseq     = "id_sequence"
+	keyformat = "key_format"
 )
@@ -3,134 +3,532 @@ package dockage
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/dgraph-io/badger"
+	"github.com/dgraph-io/badger/options"
 )
 
 //-----------------------------------------------------------------------------
 
 // DB represents a database instance.
 type DB struct {
+	lastSeq uint64 // atomic, the last rev given by this process
+	gcAt    int64  // atomic, unix nanoseconds of the last value log rewrite
+
 	db     *badger.DB
 	views  views
 	sqView View
 	sq     *badger.Sequence
+	sqMu   sync.RWMutex // guards sq, while it is moved by Import(...)
+	idgen  IDGenerator
+
+	statsSq  *badger.Sequence
+	statsMu  sync.Mutex
+	folding  int32 // atomic, 1 while foldLater() runs
+	foldDone sync.WaitGroup
+
+	obs Observer
+
+	tmpDir string // removed by Close(), for Options.InMemory
+
+	gcRatio float64
+	gcMu    sync.Mutex
+	gcStop  chan struct{}
+	gcDone  sync.WaitGroup
 }
 
 // Open opens the database with provided options.
 func Open(opt Options) (resdb *DB, reserr error) {
-	bopt := badger.DefaultOptions
-	bopt.Dir = opt.Dir
-	bopt.ValueDir = opt.ValueDir
-	bdb, err := badger.Open(bopt)
+	if opt.InMemory {
+		return openInMemory(opt, Open)
+	}
+	bdb, err := openBadger(opt)
 	if err != nil {
 		return nil, err
 	}
-	sq, err := bdb.GetSequence([]byte(pat4Sys(dbseq)), 512)
+	if opt.ReadOnly {
+		return openReadOnly(bdb, opt)
+	}
+	if err := migrateKeys(bdb); err != nil {
+		bdb.Close()
+		return nil, err
+	}
+	sq, err := bdb.GetSequence([]byte(pat4Sys(dbseq)), revBandwidth)
+	if err != nil {
+		reserr = err
+		return
+	}
+	if b, ok := opt.IDGenerator.(dbBinder); ok {
+		if err := b.bind(bdb); err != nil {
+			sq.Release()
+			bdb.Close()
+			reserr = err
+			return
+		}
+	}
+	if err := initCounts(bdb, sqNS); err != nil {
+		sq.Release()
+		bdb.Close()
+		reserr = err
+		return
+	}
+	statsSq, err := bdb.GetSequence([]byte(pat4Sys(statsSeq)), 128)
 	if err != nil {
+		sq.Release()
+		bdb.Close()
 		reserr = err
 		return
 	}
-	resdb = &DB{db: bdb, sq: sq}
+	resdb = &DB{db: bdb, sq: sq, idgen: opt.IDGenerator, statsSq: statsSq, obs: observerOf(opt)}
+	resdb.startGC(opt)
 	resdb.sqView = newView(viewdbseq,
 		func(em Emitter, id string, doc interface{}) (inf interface{}, err error) {
-			sq, err := resdb.sq.Next()
+			ix, err := resdb.nextRev()
 			if err != nil {
 				return nil, err
 			}
-			// TODO:
-			if sq > 1000 && sq%1000 == 0 {
-				go resdb.db.RunValueLogGC(0.5)
-			}
-			ix := make([]byte, 8)
-			binary.BigEndian.PutUint64(ix, sq)
-			ix = []byte(hex.EncodeToString(ix))
 			em.Emit(ix, nil)
 			return ix, nil
 		})
+	resdb.sqView.ns = sqNS
+	return
+}
+
+// openReadOnly opens a database without writing to it; there is no sequence
+// of revs, so Put(...) fails.
+func openReadOnly(bdb *badger.DB, opt Options) (resdb *DB, reserr error) {
+	format, err := keyFormat(bdb)
+	if err != nil {
+		bdb.Close()
+		return nil, err
+	}
+	if string(format) != currentKeyFormat {
+		bdb.Close()
+		return nil, fmt.Errorf("%w: keys must be migrated, by opening the database for writing", ErrReadOnly)
+	}
+	resdb = &DB{db: bdb, idgen: opt.IDGenerator, obs: observerOf(opt)}
+	resdb.sqView = newView(viewdbseq,
+		func(em Emitter, id string, doc interface{}) (inf interface{}, err error) {
+			return nil, ErrReadOnly
+		})
+	resdb.sqView.ns = sqNS
 	return
 }
 
+// openInMemory opens a database by open, in a new temporary directory that
+// is removed by Close(). The storage has no in-memory mode, so the directory
+// is put in shared memory, where there is one.
+func openInMemory(opt Options, open func(Options) (*DB, error)) (resdb *DB, reserr error) {
+	if reserr = opt.validate(); reserr != nil {
+		return
+	}
+	parent := os.TempDir()
+	if stat, err := os.Stat(shmDir); err == nil && stat.IsDir() {
+		parent = shmDir
+	}
+	dir, err := ioutil.TempDir(parent, "dockage")
+	if err != nil {
+		return nil, err
+	}
+	opt.Dir, opt.ValueDir, opt.InMemory = dir, dir, false
+	resdb, reserr = open(opt)
+	if reserr != nil {
+		os.RemoveAll(dir)
+		return
+	}
+	resdb.tmpDir = dir
+	return
+}
+
+const shmDir = "/dev/shm"
+
+// revBandwidth is how many revs are leased at once from the storage.
+const revBandwidth = 512
+
+// nextRev returns a new rev, the hex of the next number of the sequence.
+func (db *DB) nextRev() ([]byte, error) {
+	if db.sq == nil {
+		return nil, ErrReadOnly
+	}
+	db.sqMu.RLock()
+	sq, err := db.sq.Next()
+	db.sqMu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	for last := atomic.LoadUint64(&db.lastSeq); sq > last; last = atomic.LoadUint64(&db.lastSeq) {
+		if atomic.CompareAndSwapUint64(&db.lastSeq, last, sq) {
+			break
+		}
+	}
+	ix := make([]byte, 8)
+	binary.BigEndian.PutUint64(ix, sq)
+	return []byte(hex.EncodeToString(ix)), nil
+}
+
+func observerOf(opt Options) Observer {
+	if opt.Observer == nil {
+		return nopObserver{}
+	}
+	return opt.Observer
+}
+
+// update runs fn in a write transaction of operation op, inside a span.
+func (db *DB) update(op string, fn func(txn *badger.Txn) error) (reserr error) {
+	return db.updateContext(context.Background(), op, fn)
+}
+
+// updateContext is like update; if ctx is done, the transaction is discarded
+// and ctx.Err() is returned.
+func (db *DB) updateContext(ctx context.Context, op string, fn func(txn *badger.Txn) error) (reserr error) {
+	end := db.obs.StartSpan(op, true)
+	reserr = db.db.Update(withContext(ctx, fn))
+	end(reserr)
+	return
+}
+
+// view runs fn in a read transaction of operation op, inside a span.
+func (db *DB) view(op string, fn func(txn *badger.Txn) error) (reserr error) {
+	return db.viewContext(context.Background(), op, fn)
+}
+
+// viewContext is like view; if ctx is done, ctx.Err() is returned.
+func (db *DB) viewContext(ctx context.Context, op string, fn func(txn *badger.Txn) error) (reserr error) {
+	end := db.obs.StartSpan(op, false)
+	reserr = db.db.View(withContext(ctx, fn))
+	end(reserr)
+	return
+}
+
+// withContext wraps fn, to fail with ctx.Err() if ctx is done before fn
+// starts or after it returns, so the transaction is not committed.
+func withContext(ctx context.Context, fn func(txn *badger.Txn) error) func(txn *badger.Txn) error {
+	if ctx.Done() == nil {
+		return fn
+	}
+	return func(txn *badger.Txn) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(txn); err != nil {
+			return err
+		}
+		return ctx.Err()
+	}
+}
+
+// done reports the end of operation op, started at start, to the observer.
+func (db *DB) done(op string, start time.Time, err *error) {
+	db.obs.OpDone(op, time.Since(start), *err)
+	if errors.Is(*err, ErrNoMatchRev) {
+		db.obs.Conflict(op)
+	}
+}
+
+func openBadger(opt Options) (*badger.DB, error) {
+	if err := opt.validate(); err != nil {
+		return nil, err
+	}
+	bopt := badger.DefaultOptions
+	bopt.Dir = opt.Dir
+	bopt.ValueDir = opt.ValueDir
+	bopt.ReadOnly = opt.ReadOnly
+	if opt.NoSyncWrites {
+		bopt.SyncWrites = false
+	}
+	bopt.Truncate = opt.Truncate
+	if opt.TableLoadingMode != LoadDefault {
+		bopt.TableLoadingMode = opt.TableLoadingMode.fileLoadingMode()
+	}
+	if opt.ValueLogLoadingMode != LoadDefault {
+		bopt.ValueLogLoadingMode = opt.ValueLogLoadingMode.fileLoadingMode()
+	}
+	if opt.ValueThreshold > 0 {
+		bopt.ValueThreshold = opt.ValueThreshold
+	}
+	if opt.MaxTableSize > 0 {
+		bopt.MaxTableSize = opt.MaxTableSize
+	}
+	if opt.NumMemtables > 0 {
+		bopt.NumMemtables = opt.NumMemtables
+	}
+	if opt.Logger != nil {
+		bopt.Logger = opt.Logger
+	}
+	if opt.Badger != nil {
+		opt.Badger(&bopt)
+	}
+	return badger.Open(bopt)
+}
+
 // Close closes the database.
 func (db *DB) Close() error {
-	db.sq.Release()
-	return db.db.Close()
+	db.stopGC()
+	if db.sq != nil {
+		db.sq.Release()
+	}
+	if db.statsSq != nil {
+		db.foldDone.Wait()
+		db.foldCounts()
+		db.statsSq.Release()
+	}
+	if b, ok := db.idgen.(dbBinder); ok {
+		b.release()
+	}
+	err := db.db.Close()
+	if db.tmpDir != "" {
+		os.RemoveAll(db.tmpDir)
+	}
+	return err
 }
 
 // AddView adds a view. All views must be added right after Open(...). It
-// is not safe to call this method concurrently.
-func (db *DB) AddView(v View) { db.views = append(db.views, v) }
+// is not safe to call this method concurrently. The first time a view is
+// added, it gets an id in the view catalog of the database.
+func (db *DB) AddView(v View) (reserr error) {
+	v.ns, reserr = registerView(db.db, v.name)
+	if reserr != nil {
+		return
+	}
+	if reserr = initCounts(db.db, v.ns); reserr != nil {
+		return
+	}
+	db.views = append(db.views, v)
+	return
+}
 
-// DeleteView deletes the data of a view.
+// DeleteView deletes the data of a view. If the view is not registered, it is
+// removed from the view catalog too.
 func (db *DB) DeleteView(v string) (reserr error) {
-	name := string(fnvhash([]byte(v)))
-	prefix := []byte(pat4View(name))
-	reserr = db.db.Update(func(txn *badger.Txn) error {
-		opt := badger.DefaultIteratorOptions
-		opt.PrefetchValues = false
-		itr := txn.NewIterator(opt)
-		defer itr.Close()
-		var todelete [][]byte
-		for itr.Seek(prefix); itr.ValidForPrefix(prefix); itr.Next() {
-			item := itr.Item()
-			k := item.KeyCopy(nil)
-			v, err := item.ValueCopy(nil)
+	return db.DeleteViewContext(context.Background(), v)
+}
+
+// DeleteViewContext is like DeleteView; if ctx is done, nothing is deleted
+// and ctx.Err() is returned.
+func (db *DB) DeleteViewContext(ctx context.Context, v string) (reserr error) {
+	if reserr = db.foldCounts(); reserr != nil {
+		return
+	}
+	reserr = db.updateContext(ctx, "delete_view", func(txn *badger.Txn) error {
+		ns, found, err := db.viewNS(txn, v)
+		if err != nil || !found {
+			return err
+		}
+		if err := deleteView(ctx, txn, ns); err != nil {
+			return err
+		}
+		tx := newTransaction(ctx, txn, db.obs)
+		if err := db.resetCounts(tx, ns); err != nil {
+			return err
+		}
+		if err := db.writeCounts(tx); err != nil {
+			return err
+		}
+		if _, ok := db.views.find(v); !ok {
+			return txn.Delete(catalogKey(v))
+		}
+		return nil
+	})
+	return
+}
+
+// RebuildView deletes the data of a view and builds it again from
+// the stored documents. Only views that work on stored json, like the ones
+// created by NewFieldView(...), can be rebuilt. Documents are built in
+// batches, each in its own transaction, so while it runs, queries see
+// the view partly built.
+func (db *DB) RebuildView(v string) (reserr error) {
+	return db.RebuildViewContext(context.Background(), v)
+}
+
+// RebuildViewContext is like RebuildView; ctx is checked between batches,
+// and if it is done, ctx.Err() is returned and the view is left partly
+// built, until it is rebuilt again.
+func (db *DB) RebuildViewContext(ctx context.Context, v string) (reserr error) {
+	vw, ok := db.views.find(v)
+	if !ok {
+		return ErrViewNotFound
+	}
+	if !vw.jsonDoc {
+		return ErrViewNotRebuildable
+	}
+	if reserr = db.foldCounts(); reserr != nil {
+		return
+	}
+	reserr = db.updateContext(ctx, "rebuild_view", func(txn *badger.Txn) error {
+		tx := newTransaction(ctx, txn, db.obs)
+		if err := db.resetCounts(tx, vw.ns); err != nil {
+			return err
+		}
+		return db.writeCounts(tx)
+	})
+	if reserr != nil {
+		return
+	}
+	if reserr = db.clearView(ctx, vw.ns); reserr != nil {
+		return
+	}
+	prefix := []byte(keysp)
+	start := prefix
+	for n := rebuildBatch; ; {
+		if reserr = ctx.Err(); reserr != nil {
+			return
+		}
+		var next []byte
+		err := db.updateContext(ctx, "rebuild_view", func(txn *badger.Txn) error {
+			next = nil
+			var docs []idd
+			opt := badger.DefaultIteratorOptions
+			err := itrFuncContext(ctx, txn, opt, start, prefix, func(itr interface{ Item() *badger.Item }) error {
+				item := itr.Item()
+				if len(docs) == n {
+					next = item.KeyCopy(nil)
+					return errStop
+				}
+				js, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				id := string(bytes.TrimPrefix(item.Key(), prefix))
+				docs = append(docs, idd{ID: id, JS: js})
+				return nil
+			})
 			if err != nil {
 				return err
 			}
-			if len(k) != 0 {
-				todelete = append(todelete, k)
-			}
-			if len(v) != 0 {
-				todelete = append(todelete, v)
+			tx := newTransaction(ctx, txn, db.obs)
+			for _, d := range docs {
+				em := newViewEmitter(tx, vw)
+				if _, err := em.build(d.ID, json.RawMessage(d.JS)); err != nil {
+					return err
+				}
 			}
+			return db.writeCounts(tx)
+		})
+		if err == badger.ErrTxnTooBig && n > 1 {
+			db.obs.TxnSplit("rebuild_view")
+			n /= 2
+			continue
 		}
-		for _, vd := range todelete {
-			if err := txn.Delete(vd); err != nil {
-				return err
-			}
+		if err != nil || next == nil {
+			return err
+		}
+		start = next
+	}
+}
+
+// rebuildBatch is how many documents RebuildView(...) builds in one
+// transaction; halved when a transaction gets too big.
+const rebuildBatch = 1000
+
+// clearView deletes the data of view ns, in as many transactions as needed.
+func (db *DB) clearView(ctx context.Context, ns string) error {
+	prefix := []byte(pat4View(ns))
+	for {
+		var ops []kvop
+		err := db.viewContext(ctx, "rebuild_view", func(txn *badger.Txn) error {
+			opt := badger.DefaultIteratorOptions
+			opt.PrefetchValues = false
+			return itrFuncContext(ctx, txn, opt, prefix, prefix, func(itr interface{ Item() *badger.Item }) error {
+				if len(ops) == 10*rebuildBatch {
+					return errStop
+				}
+				ops = append(ops, kvop{key: itr.Item().KeyCopy(nil), del: true})
+				return nil
+			})
+		})
+		if err != nil || len(ops) == 0 {
+			return err
+		}
+		if err := applyOps(db.db, ops); err != nil {
+			return err
 		}
+	}
+}
+
+func deleteView(ctx context.Context, txn *badger.Txn, ns string) error {
+	prefix := []byte(pat4View(ns))
+	opt := badger.DefaultIteratorOptions
+	opt.PrefetchValues = false
+	// all keys of the view are inside its namespace, values are not keys
+	// in every domain.
+	var todelete [][]byte
+	err := itrFuncContext(ctx, txn, opt, prefix, prefix, func(itr interface{ Item() *badger.Item }) error {
+		todelete = append(todelete, itr.Item().KeyCopy(nil))
 		return nil
 	})
-	return
+	if err != nil {
+		return err
+	}
+	for _, vd := range todelete {
+		if err := txn.Delete(vd); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Put a list of documents inside database, in a single transaction.
 // Document must have a json field named "id" and  a json field named "rev".
+// If a document already exists and its rev does not match the provided
+// rev, a *ConflictError is returned and nothing is written.
+// If the id is empty and Options.IDGenerator is set, a new id is generated
+// and written back into the document.
 // All documents passed by docs parameter will be inserted into the database
 // in one transaction. Also all views will be computer in the same transaction.
 func (db *DB) Put(docs ...interface{}) (reserr error) {
+	return db.PutContext(context.Background(), docs...)
+}
+
+// PutContext is like Put; if ctx is done, nothing is written and ctx.Err()
+// is returned.
+func (db *DB) PutContext(ctx context.Context, docs ...interface{}) (reserr error) {
 	if len(docs) == 0 {
 		return
 	}
-	reserr = db.db.Update(func(txn *badger.Txn) error {
+	defer db.done("put", time.Now(), &reserr)
+	reserr = db.updateContext(ctx, "put", func(txn *badger.Txn) error {
+		tx := newTransaction(ctx, txn, db.obs)
 		var builds []idd
 		for _, vdoc := range docs {
-			id, frev, err := prepdoc(vdoc)
+			id, frev, err := prepdoc(vdoc, db.idgen)
 			if err != nil {
 				return err
 			}
 
-			qres, _, qerr := db.queryView(Q{View: viewdbseq, Start: id, Prefix: id}, txn, true)
+			current, qerr := db.currentRev(txn, string(id))
 			if qerr != nil {
 				return qerr
 			}
 
-			if frev == nil {
-				if len(qres) > 0 {
-					return ErrNoMatchRev
+			rev := frev.Value().(string)
+			if current != nil && string(current) != rev {
+				return &ConflictError{
+					ID:         string(id),
+					Rev:        rev,
+					CurrentRev: string(current),
 				}
 			}
-
-			if len(qres) > 0 && bytes.Compare(qres[0].Key, []byte(frev.Value().(string))) != 0 {
-				return ErrNoMatchRev
+			if current == nil {
+				if err := clearTombstone(txn, string(id)); err != nil {
+					return err
+				}
 			}
 
-			em := newViewEmitter(newTransaction(txn), db.sqView)
+			em := newViewEmitter(tx, db.sqView)
 			resinf, reserr := em.build(string(id), vdoc)
 			if reserr != nil {
 				return reserr
@@ -147,14 +545,27 @@ func (db *DB) Put(docs ...interface{}) (reserr error) {
 				return err
 			}
 
-			builds = append(builds, idd{ID: string(id), Doc: vdoc})
+			builds = append(builds, idd{ID: string(id), Doc: vdoc, JS: js})
 		}
 		for _, v := range builds {
-			tx := newTransaction(txn)
-			if _, err := db.views.buildAll(tx, v.ID, v.Doc); err != nil {
+			if _, err := db.views.buildAll(tx, v.ID, v.Doc, v.JS); err != nil {
 				return err
 			}
 		}
+		return db.writeCounts(tx)
+	})
+	return
+}
+
+// currentRev returns the rev of the stored document, or nil if there is none.
+func (db *DB) currentRev(txn *badger.Txn, id string) (resrev []byte, reserr error) {
+	prefix := k2xPrefix(db.sqView.ns, id)
+	opt := badger.DefaultIteratorOptions
+	opt.PrefetchValues = false
+	reserr = itrFunc(txn, opt, prefix, prefix, func(itr interface{ Item() *badger.Item }) error {
+		if resrev == nil {
+			resrev = bytes.TrimPrefix(itr.Item().KeyCopy(nil), prefix)
+		}
 		return nil
 	})
 	return
@@ -162,17 +573,22 @@ func (db *DB) Put(docs ...interface{}) (reserr error) {
 
 // Get a list of documents based on their ids. Param docs is pointer to
 // slice of struct. All documents will be read from database in one read transaction.
+// If any of the documents does not exist, ErrNotFound is returned.
 func (db *DB) Get(docs interface{}, firstID string, restID ...string) (reserr error) {
+	return db.GetContext(context.Background(), docs, firstID, restID...)
+}
+
+// GetContext is like Get; if ctx is done, ctx.Err() is returned.
+func (db *DB) GetContext(ctx context.Context, docs interface{}, firstID string, restID ...string) (reserr error) {
+	defer db.done("get", time.Now(), &reserr)
 	ids := append([]string{firstID}, restID...)
-	reserr = db.db.View(func(txn *badger.Txn) error {
+	reserr = db.viewContext(ctx, "get", func(txn *badger.Txn) error {
 		var reslist []string
 		for _, vid := range ids {
-			vid := pat4Key(vid)
-			item, err := txn.Get([]byte(vid))
-			if err != nil {
+			if err := ctx.Err(); err != nil {
 				return err
 			}
-			v, err := item.ValueCopy(nil)
+			v, err := getDoc(txn, vid)
 			if err != nil {
 				return err
 			}
@@ -184,84 +600,159 @@ func (db *DB) Get(docs interface{}, firstID string, restID ...string) (reserr er
 	return
 }
 
+// GetMany reads a list of documents based on their ids, in one read
+// transaction, and reports the outcome for each id separately. Results are
+// in the same order as ids. A missing document does not fail the whole
+// batch; its result has Err set to ErrNotFound, or it is left out if
+// opt.SkipMissing is set.
+func (db *DB) GetMany(ids []string, opt GetOptions) (reslist []GetRes, reserr error) {
+	return db.GetManyContext(context.Background(), ids, opt)
+}
+
+// GetManyContext is like GetMany; if ctx is done, ctx.Err() is returned.
+func (db *DB) GetManyContext(ctx context.Context, ids []string, opt GetOptions) (reslist []GetRes, reserr error) {
+	defer db.done("get_many", time.Now(), &reserr)
+	reserr = db.viewContext(ctx, "get_many", func(txn *badger.Txn) error {
+		for _, vid := range ids {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			v, err := getDoc(txn, vid)
+			if err == ErrNotFound && opt.SkipMissing {
+				continue
+			}
+			reslist = append(reslist, GetRes{ID: vid, Doc: v, Err: err})
+		}
+		return nil
+	})
+	return
+}
+
+func getDoc(txn *badger.Txn, id string) ([]byte, error) {
+	item, err := txn.Get([]byte(pat4Key(id)))
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item.ValueCopy(nil)
+}
+
 // Delete a list of documents based on their ids.
 // All documents will be deleted from database in one write transaction.
 func (db *DB) Delete(ids ...string) (reserr error) {
+	return db.DeleteContext(context.Background(), ids...)
+}
+
+// DeleteContext is like Delete; if ctx is done, nothing is deleted and
+// ctx.Err() is returned.
+func (db *DB) DeleteContext(ctx context.Context, ids ...string) (reserr error) {
 	if len(ids) == 0 {
 		return
 	}
-	reserr = db.db.Update(func(txn *badger.Txn) error {
-		var viewList views = append([]View{db.sqView}, db.views...)
-		for _, vid := range ids {
-			if err := txn.Delete([]byte(keysp + vid)); err != nil {
-				return err
-			}
+	defer db.done("delete", time.Now(), &reserr)
+	reserr = db.updateContext(ctx, "delete", func(txn *badger.Txn) error {
+		return db.deleteDocs(ctx, txn, ids...)
+	})
+	return
+}
+
+// DeleteRev deletes a document, if rev is its current rev. Otherwise
+// a *ConflictError is returned and nothing is deleted. It returns ErrNotFound
+// if there is no document with this id.
+func (db *DB) DeleteRev(id, rev string) (reserr error) {
+	return db.DeleteRevContext(context.Background(), id, rev)
+}
+
+// DeleteRevContext is like DeleteRev; if ctx is done, nothing is deleted and
+// ctx.Err() is returned.
+func (db *DB) DeleteRevContext(ctx context.Context, id, rev string) (reserr error) {
+	defer db.done("delete_rev", time.Now(), &reserr)
+	reserr = db.updateContext(ctx, "delete_rev", func(txn *badger.Txn) error {
+		current, err := db.currentRev(txn, id)
+		if err != nil {
+			return err
 		}
-		for _, vid := range ids {
-			tx := newTransaction(txn)
-			if _, err := viewList.buildAll(tx, vid, nil); err != nil {
-				return err
-			}
+		if current == nil {
+			return ErrNotFound
 		}
-		return nil
+		if string(current) != rev {
+			return &ConflictError{ID: id, Rev: rev, CurrentRev: string(current)}
+		}
+		return db.deleteDocs(ctx, txn, id)
 	})
 	return
 }
 
+func (db *DB) deleteDocs(ctx context.Context, txn *badger.Txn, ids ...string) error {
+	var viewList views = append([]View{db.sqView}, db.views...)
+	existed := make(map[string]bool, len(ids))
+	for _, vid := range ids {
+		current, err := db.currentRev(txn, vid)
+		if err != nil {
+			return err
+		}
+		existed[vid] = current != nil
+		if err := txn.Delete([]byte(keysp + vid)); err != nil {
+			return err
+		}
+	}
+	tx := newTransaction(ctx, txn, db.obs)
+	for _, vid := range ids {
+		if _, err := viewList.buildAll(tx, vid, nil, nil); err != nil {
+			return err
+		}
+		if existed[vid] {
+			existed[vid] = false
+			if err := db.addTombstone(txn, vid); err != nil {
+				return err
+			}
+		}
+	}
+	return db.writeCounts(tx)
+}
+
 // Query queries a view using provided parameters. If no View is provided, it searches
 // all ids using parameters. Number of results is always limited - default 100 documents.
 // If total count for a query is needed by setting params.Count to true, no documents
 // will be returned - because it might be a costly action. All documents will be read
 // from database in one read transaction.
+//
+// To look up many keys at once, set params.Keys and params.Ranges instead of
+// Start, End and Prefix. Results are grouped per key and range, in the order
+// they are given, and Res.Group tells which one produced a result.
 func (db *DB) Query(params Q) (reslist []Res, rescount int, reserr error) {
-	reslist, rescount, reserr = db.queryView(params, nil)
+	return db.QueryContext(context.Background(), params)
+}
+
+// QueryContext is like Query; if ctx is done, ctx.Err() is returned.
+func (db *DB) QueryContext(ctx context.Context, params Q) (reslist []Res, rescount int, reserr error) {
+	defer db.done("query", time.Now(), &reserr)
+	reslist, rescount, reserr = db.queryView(ctx, params, nil)
 	return
 }
 
-func (db *DB) queryView(params Q, parentTxn *badger.Txn, forIndexedKeys ...bool) (reslist []Res, rescount int, reserr error) {
+func (db *DB) queryView(ctx context.Context, params Q, parentTxn *badger.Txn) (reslist []Res, rescount int, reserr error) {
 	params.init()
 
-	start, end, prefix := stopWords(params, forIndexedKeys...)
+	var (
+		end   []byte
+		group int
+		seen  map[string]bool
+	)
+	if params.Distinct {
+		seen = make(map[string]bool)
+	}
 
 	skip, limit, applySkip, applyLimit := getlimits(params)
 
 	body := func(itr interface{ Item() *badger.Item }) error {
-		if params.Count {
-			rescount++
-			skip--
-			if applySkip && skip >= 0 {
-				return nil
-			}
-			if applyLimit && limit <= 0 {
-				return nil
-			}
-			limit--
-			if len(end) > 0 {
-				item := itr.Item()
-				k := item.Key()
-				if bytes.Compare(k, end) > 0 {
-					return nil
-				}
-			}
-			return nil
-		}
 		item := itr.Item()
 		k := item.KeyCopy(nil)
-		skip--
-		if applySkip && skip >= 0 {
-			return nil
-		}
-		v, err := item.ValueCopy(nil)
-		if err != nil {
-			return err
-		}
-		if applyLimit && limit <= 0 {
-			return nil
-		}
-		limit--
 		if len(end) > 0 {
 			if bytes.Compare(k, end) > 0 {
-				return nil
+				return errStop
 			}
 		}
 		var index []byte
@@ -272,26 +763,85 @@ func (db *DB) queryView(params Q, parentTxn *badger.Txn, forIndexedKeys ...bool)
 		}
 		sppfx = []byte(viewsp)
 		if bytes.HasPrefix(polishedKey, sppfx) {
-			parts := bytes.Split(polishedKey, sppfx)
-			index = parts[2]
-			polishedKey = parts[3]
+			index, polishedKey = splitViewKey(polishedKey)
+		}
+		if seen != nil {
+			if seen[string(polishedKey)] {
+				return nil
+			}
+			seen[string(polishedKey)] = true
+		}
+		if params.Count {
+			rescount++
+			return nil
+		}
+		skip--
+		if applySkip && skip >= 0 {
+			return nil
+		}
+		if applyLimit && limit <= 0 {
+			return errStop
+		}
+		limit--
+		v, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
 		}
 		var rs Res
 		rs.Key = polishedKey
 		rs.Val = v
 		rs.Index = index
+		rs.Group = group
 		reslist = append(reslist, rs)
 		return nil
 	}
 
 	qfn := func(txn *badger.Txn) error {
+		var ns string
+		if params.View != "" {
+			var found bool
+			var err error
+			ns, found, err = db.viewNS(txn, params.View)
+			if err != nil || !found {
+				return err
+			}
+		}
 		var opt badger.IteratorOptions
 		opt.PrefetchValues = true
 		opt.PrefetchSize = limit
-		return itrFunc(txn, opt, start, prefix, body)
+		for _, sc := range scans(params, ns) {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			end, group = sc.end, sc.group
+			if sc.exact {
+				item, err := txn.Get(sc.start)
+				if err == badger.ErrKeyNotFound {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				err = body(itemOf{item})
+				if err == errStop {
+					break
+				}
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if err := itrFuncContext(ctx, txn, opt, sc.start, sc.prefix, body); err != nil {
+				return err
+			}
+			if applyLimit && limit <= 0 && !params.Count {
+				break
+			}
+		}
+		return nil
 	}
 	if parentTxn == nil {
-		reserr = db.db.View(qfn)
+		reserr = db.viewContext(ctx, "query", qfn)
 	} else {
 		reserr = qfn(parentTxn)
 	}
@@ -303,12 +853,25 @@ func (db *DB) queryView(params Q, parentTxn *badger.Txn, forIndexedKeys ...bool)
 }
 
 func (db *DB) unboundAll() (reslist []KV, reserr error) {
-	reserr = db.db.View(func(txn *badger.Txn) error {
+	reserr = db.Dump(nil, func(kv KV) error {
+		reslist = append(reslist, kv)
+		return nil
+	})
+	return
+}
+
+// Dump passes the raw keys and values of the database, that start with
+// prefix, to fn in key order, from one read transaction. Documents are
+// stored under "&", views under "^" and system keys under "."; the layout
+// of keys is internal and may change between versions, so Dump is meant for
+// debugging. An error returned by fn stops Dump and is returned.
+func (db *DB) Dump(prefix []byte, fn func(kv KV) error) (reserr error) {
+	reserr = db.view("dump", func(txn *badger.Txn) error {
 		opt := badger.DefaultIteratorOptions
 		opt.PrefetchValues = false
 		itr := txn.NewIterator(opt)
 		defer itr.Close()
-		for itr.Rewind(); itr.Valid(); itr.Next() {
+		for itr.Seek(prefix); itr.ValidForPrefix(prefix); itr.Next() {
 			itm := itr.Item()
 			var kv KV
 			kv.Key = itm.KeyCopy(nil)
@@ -317,7 +880,9 @@ func (db *DB) unboundAll() (reslist []KV, reserr error) {
 			if err != nil {
 				return err
 			}
-			reslist = append(reslist, kv)
+			if err := fn(kv); err != nil {
+				return err
+			}
 		}
 		return nil
 	})
@@ -332,6 +897,20 @@ type Q struct {
 	Start, End, Prefix []byte
 	Skip, Limit        int
 	Count              bool
+
+	// Keys are exact view keys (or ids, if no View is provided) to look up.
+	Keys [][]byte
+	// Ranges are like Start, End and Prefix, to be queried at once. They are
+	// numbered after Keys, in Res.Group.
+	Ranges []Range
+	// Distinct drops results for a document that is already found, by
+	// a previous key or range.
+	Distinct bool
+}
+
+// Range of view keys (or ids), see Q.
+type Range struct {
+	Start, End, Prefix []byte
 }
 
 func (q *Q) init() {
@@ -342,6 +921,15 @@ func (q *Q) init() {
 
 //-----------------------------------------------------------------------------
 
+// GetOptions are params for GetMany(...).
+type GetOptions struct {
+	// SkipMissing leaves out the ids that do not exist, instead of
+	// reporting them with ErrNotFound.
+	SkipMissing bool
+}
+
+//-----------------------------------------------------------------------------
+
 // Options are params for creating DB object.
 type Options struct {
 	// 1. Mandatory flags
@@ -351,6 +939,120 @@ type Options struct {
 	// Directory to store the value log in. Can be the same as Dir. Should
 	// exist and be writable.
 	ValueDir string
+
+	// 2. Optional flags
+	// -------------------
+	// GCInterval is how often the value log is garbage collected, in
+	// the background; every 10 minutes if zero, never if negative.
+	GCInterval time.Duration
+	// GCDiscardRatio is the fraction of a value log file that must be stale
+	// for it to be rewritten, between 0 and 1; 0.5 if zero.
+	GCDiscardRatio float64
+	// GCMaxRuns is the most value log files rewritten each interval; 10 if
+	// zero.
+	GCMaxRuns int
+	// InMemory opens a new, empty database, that is gone when it is closed,
+	// for tests and caches. Dir and ValueDir must be empty. Its files are put
+	// in a temporary directory in /dev/shm; where there is no /dev/shm, they
+	// are put in os.TempDir(), on disk.
+	InMemory bool
+	// IDGenerator is used by Put for documents with an empty id. Without it
+	// Put returns ErrNoID for such documents.
+	IDGenerator IDGenerator
+	// Observer, if set, receives the telemetry of the database, like
+	// the durations of operations and transactions; see Metrics.
+	Observer Observer
+	// ReadOnly opens the database without writing to it, so other processes
+	// can open it read-only too. Put(...), Delete(...) and view changes
+	// fail. A database in an older key format must be opened for writing
+	// first.
+	ReadOnly bool
+
+	// 3. Storage flags
+	// -------------------
+	// Zero values keep the defaults of badger.
+	//
+	// NoSyncWrites lets transactions return before their writes are
+	// synced to disk. Faster, but the last writes can be lost on a crash.
+	NoSyncWrites bool
+	// TableLoadingMode and ValueLogLoadingMode are how the LSM tables and
+	// the value log files are loaded.
+	TableLoadingMode, ValueLogLoadingMode LoadingMode
+	// ValueThreshold is the size of values, in bytes, above which they are
+	// kept in the value log, instead of the LSM tree. At most
+	// MaxValueThreshold.
+	ValueThreshold int
+	// MaxTableSize is the size, in bytes, of each memtable and LSM table.
+	MaxTableSize int64
+	// NumMemtables is the number of memtables kept in memory.
+	NumMemtables int
+	// Truncate truncates the value log at a corrupted entry, instead of
+	// failing to open. Data after it is lost; can not be used with ReadOnly.
+	Truncate bool
+	// Logger receives the logs of the storage.
+	Logger badger.Logger
+	// Badger, if set, is called with the options of badger, after the
+	// flags above are applied, for settings that are not exposed here.
+	Badger func(bopt *badger.Options)
+}
+
+// LoadingMode is how files of the storage are loaded.
+type LoadingMode int
+
+// Loading modes
+const (
+	LoadDefault LoadingMode = iota
+	LoadFileIO
+	LoadToRAM
+	LoadMemoryMap
+)
+
+// MaxValueThreshold is the largest Options.ValueThreshold.
+const MaxValueThreshold = math.MaxUint16 - 16
+
+func (m LoadingMode) fileLoadingMode() options.FileLoadingMode {
+	switch m {
+	case LoadFileIO:
+		return options.FileIO
+	case LoadToRAM:
+		return options.LoadToRAM
+	}
+	return options.MemoryMap
+}
+
+// validate checks the flags, before anything is opened.
+func (opt Options) validate() error {
+	if opt.InMemory {
+		switch {
+		case opt.Dir != "" || opt.ValueDir != "":
+			return fmt.Errorf("%w: Dir and ValueDir must be empty with InMemory", ErrInvalidOptions)
+		case opt.ReadOnly:
+			return fmt.Errorf("%w: InMemory can not be used with ReadOnly", ErrInvalidOptions)
+		}
+	}
+	switch {
+	case opt.Dir == "" && !opt.InMemory:
+		return fmt.Errorf("%w: Dir is empty", ErrInvalidOptions)
+	case opt.ValueDir == "" && !opt.InMemory:
+		return fmt.Errorf("%w: ValueDir is empty", ErrInvalidOptions)
+	case opt.TableLoadingMode < LoadDefault || opt.TableLoadingMode > LoadMemoryMap:
+		return fmt.Errorf("%w: unknown TableLoadingMode %d", ErrInvalidOptions, opt.TableLoadingMode)
+	case opt.ValueLogLoadingMode < LoadDefault || opt.ValueLogLoadingMode > LoadMemoryMap:
+		return fmt.Errorf("%w: unknown ValueLogLoadingMode %d", ErrInvalidOptions, opt.ValueLogLoadingMode)
+	case opt.ValueThreshold < 0 || opt.ValueThreshold > MaxValueThreshold:
+		return fmt.Errorf("%w: ValueThreshold %d is not between 0 and %d", ErrInvalidOptions, opt.ValueThreshold, MaxValueThreshold)
+	case opt.MaxTableSize < 0:
+		return fmt.Errorf("%w: MaxTableSize %d is negative", ErrInvalidOptions, opt.MaxTableSize)
+	case opt.NumMemtables < 0:
+		return fmt.Errorf("%w: NumMemtables %d is negative", ErrInvalidOptions, opt.NumMemtables)
+	case opt.GCDiscardRatio < 0 || opt.GCDiscardRatio >= 1:
+		return fmt.Errorf("%w: GCDiscardRatio %g is not between 0 and 1", ErrInvalidOptions, opt.GCDiscardRatio)
+	case opt.GCMaxRuns < 0:
+		return fmt.Errorf("%w: GCMaxRuns %d is negative", ErrInvalidOptions, opt.GCMaxRuns)
+	case opt.Truncate && opt.ReadOnly:
+		return fmt.Errorf("%w: Truncate can not be used with ReadOnly", ErrInvalidOptions)
+	}
+	return nil
 }
 
 //-----------------------------------------------------------------------------
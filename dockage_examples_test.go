@@ -3,36 +3,15 @@ package dockage
 import (
 	"encoding/binary"
 	"fmt"
-	"io/ioutil"
-	"os"
-	"path/filepath"
 	"time"
-)
 
-func createDB() *DB {
-	databaseDir, _ := ioutil.TempDir(os.TempDir(), "database")
-	{
-		stat, err := os.Stat(databaseDir)
-		if err != nil {
-			if !os.IsNotExist(err) {
-				panic(err)
-			}
-		}
-		if stat != nil {
-			if err := os.RemoveAll(databaseDir); err != nil {
-				panic(err)
-			}
-		}
-	}
-	index := filepath.Join(databaseDir, "index")
-	data := filepath.Join(databaseDir, "data")
+	"github.com/dc0d/dockage/keys"
+)
 
-	mkdir(index)
-	mkdir(data)
+func createDB() *DB { return createDBWith(Options{}) }
 
-	var opts Options
-	opts.Dir = index
-	opts.ValueDir = data
+func createDBWith(opts Options) *DB {
+	opts.InMemory = true
 	preppedDB, err := Open(opts)
 	if err != nil {
 		panic(err)
@@ -131,7 +110,7 @@ func ExampleDB_cas() {
 	// Hi!
 	// [tech golang]
 	// 0000000000000000
-	// error: rev field in doc json not matching
+	// error: rev field in doc json not matching: id CMNT::001 rev "dummy" current rev "0000000000000000"
 	// <nil>
 	// <nil>
 	// CMNT::001
@@ -164,7 +143,7 @@ func ExampleDB_Delete() {
 	// Output:
 	// <nil>
 	// <nil>
-	// Key not found []
+	// document not found []
 }
 
 func ExampleView() {
@@ -550,6 +529,43 @@ func ExampleDB_Get() {
 	// CMNT::003 Hi! Frodo Baggins
 }
 
+func ExampleDB_GetMany() {
+	db := createDB()
+	defer db.Close()
+
+	var list []interface{}
+	for i := 1; i <= 3; i += 2 {
+		cmnt := comment{
+			ID:   fmt.Sprintf("CMNT::%03d", i),
+			By:   "Frodo Baggins",
+			Text: "Hi!",
+		}
+		list = append(list, cmnt)
+	}
+	fmt.Println(db.Put(list...))
+
+	ids := []string{"CMNT::003", "CMNT::002", "CMNT::001"}
+	res, err := db.GetMany(ids, GetOptions{})
+	fmt.Println(err)
+
+	for _, v := range res {
+		var c comment
+		err := v.Unmarshal(&c)
+		fmt.Println(v.ID, v.Found(), c.Text, err)
+	}
+
+	res, err = db.GetMany(ids, GetOptions{SkipMissing: true})
+	fmt.Println(err, len(res), res[0].ID, res[1].ID)
+
+	// Output:
+	// <nil>
+	// <nil>
+	// CMNT::003 true Hi! <nil>
+	// CMNT::002 false  document not found
+	// CMNT::001 true Hi! <nil>
+	// <nil> 2 CMNT::003 CMNT::001
+}
+
 func ExampleView_timestampInt64() {
 	db := createDB()
 	defer db.Close()
@@ -611,6 +627,59 @@ func ExampleView_timestampInt64() {
 	// CMNT::003  000000005a4c9488
 }
 
+func ExampleView_keys() {
+	db := createDB()
+	defer db.Close()
+
+	type reading struct {
+		ID    string    `json:"id"`
+		Rev   string    `json:"rev"`
+		Temp  int64     `json:"temp"`
+		Where string    `json:"where"`
+		At    time.Time `json:"at"`
+	}
+
+	// keys.MustEncode encodes a tuple, that sorts by where, then temp,
+	// then at; negative numbers included.
+	db.AddView(NewView("where-temp",
+		func(em Emitter, id string, doc interface{}) {
+			c, ok := doc.(*reading)
+			if !ok {
+				return
+			}
+			em.Emit(keys.MustEncode(c.Where, c.Temp, c.At), nil)
+		}))
+
+	at := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	var list []interface{}
+	for i, temp := range []int64{3, -12, -2, 0} {
+		list = append(list, &reading{
+			ID:    fmt.Sprintf("R::%03d", i+1),
+			Temp:  temp,
+			Where: "Shire",
+			At:    at.Add(time.Hour * time.Duration(i)),
+		})
+	}
+	fmt.Println(db.Put(list...))
+
+	start, _ := keys.Encode("Shire", -5)
+	prefix, _ := keys.Prefix("Shire")
+	res, _, err := db.Query(Q{View: "where-temp", Start: start, Prefix: prefix})
+	fmt.Println(err)
+
+	for _, v := range res {
+		parts, _ := keys.Decode(v.Index)
+		fmt.Println(string(v.Key), parts[0], parts[1], parts[2].(time.Time).Format(time.Kitchen))
+	}
+
+	// Output:
+	// <nil>
+	// <nil>
+	// R::003 Shire -2 2:00PM
+	// R::004 Shire 0 3:00PM
+	// R::001 Shire 3 12:00PM
+}
+
 func ExampleView_count() {
 	db := createDB()
 	defer db.Close()
@@ -2,16 +2,25 @@ package dockage
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/dc0d/dockage/keys"
+	"github.com/dgraph-io/badger"
+	"github.com/dgraph-io/badger/options"
 	"github.com/stretchr/testify/require"
 )
 
@@ -47,30 +56,7 @@ func mkdir(d string) {
 }
 
 func initdb() {
-	databaseDir, _ := ioutil.TempDir(os.TempDir(), "database")
-	{
-		stat, err := os.Stat(databaseDir)
-		if err != nil {
-			if !os.IsNotExist(err) {
-				panic(err)
-			}
-		}
-		if stat != nil {
-			if err := os.RemoveAll(databaseDir); err != nil {
-				panic(err)
-			}
-		}
-	}
-	index := filepath.Join(databaseDir, "index")
-	data := filepath.Join(databaseDir, "data")
-
-	mkdir(index)
-	mkdir(data)
-
-	var opts Options
-	opts.Dir = index
-	opts.ValueDir = data
-	preppedDB, err := Open(opts)
+	preppedDB, err := Open(Options{InMemory: true})
 	if err != nil {
 		panic(err)
 	}
@@ -109,9 +95,28 @@ func TestPutDelete(t *testing.T) {
 
 	wg.Wait()
 
+	require.NoError(db.foldCounts())
+	stats, err := db.Stats()
+	require.NoError(err)
+	require.Equal(0, stats.Docs)
 	l, err := db.unboundAll()
 	require.NoError(err)
-	require.Equal(0+1 /* dbseq */, len(l))
+	// only tombstones of deleted documents are left in views
+	var left []string
+	var tombstones, deleted int
+	for _, kv := range l {
+		switch {
+		case bytes.HasPrefix(kv.Key, []byte(pat4Sys(statsBase, ""))):
+		case bytes.HasPrefix(kv.Key, tombstoneKey("")):
+			deleted++
+		case bytes.HasPrefix(kv.Key, []byte(pat4View(sqNS+viewx2k))) && bytes.Equal(kv.Val, tombstone):
+			tombstones++
+		default:
+			left = append(left, string(kv.Key))
+		}
+	}
+	require.Equal([]string{pat4Sys(dbseq), pat4Sys(keyformat), pat4Sys(statsSeq)}, left)
+	require.Equal(deleted, tombstones)
 }
 
 func testPutDelete(wg *sync.WaitGroup, start, n int, require *require.Assertions) {
@@ -315,10 +320,23 @@ func TestRevPut(t *testing.T) {
 	rev1 := c.Rev
 
 	c.Rev = "QQ"
-	require.Equal(ErrNoMatchRev, db.Put(c))
+	err := db.Put(c)
+	require.True(errors.Is(err, ErrNoMatchRev))
+	var conflict *ConflictError
+	require.True(errors.As(err, &conflict))
+	require.Equal("C4", conflict.ID)
+	require.Equal("QQ", conflict.Rev)
+	require.Equal(rev1, conflict.CurrentRev)
 
 	c.Rev = ""
-	require.Equal(ErrNoMatchRev, db.Put(c))
+	err = db.Put(&comment{ID: "C5"}, c)
+	require.True(errors.Is(err, ErrNoMatchRev))
+	require.True(errors.As(err, &conflict))
+	require.Equal("C4", conflict.ID)
+	require.Equal("", conflict.Rev)
+	require.Equal(rev1, conflict.CurrentRev)
+	var res []comment
+	require.Equal(ErrNotFound, db.Get(&res, "C5"))
 
 	{
 		var res []comment
@@ -388,6 +406,344 @@ type Data struct {
 	Text string
 }
 
+func TestRevPutSharedPrefix(t *testing.T) {
+	require := require.New(t)
+
+	require.NoError(db.Put(&comment{ID: "PFX:10"}))
+	c := &comment{ID: "PFX:1"}
+	require.NoError(db.Put(c))
+	require.NoError(db.Put(c))
+	require.NoError(db.Delete("PFX:1", "PFX:10"))
+}
+
+func TestSegment(t *testing.T) {
+	require := require.New(t)
+
+	for _, seg := range []string{"", "a", "^&.<>", "a\x00b", "\x00\x01", "\xff"} {
+		k := appendSegment([]byte("P"), []byte(seg))
+		got, rest, ok := readSegment(append(k[1:], "REST"...))
+		require.True(ok)
+		require.Equal(seg, string(got))
+		require.Equal("REST", string(rest))
+	}
+
+	ordered := []string{"", "\x00", "\x00\x00", "\x00a", "a", "a\x00", "a\x01", "ab"}
+	for i := 1; i < len(ordered); i++ {
+		prev := appendSegment(nil, []byte(ordered[i-1]))
+		next := appendSegment(nil, []byte(ordered[i]))
+		require.True(bytes.Compare(prev, next) < 0, "%q < %q", ordered[i-1], ordered[i])
+	}
+}
+
+func TestAnyIDAndViewKey(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB()
+	defer db.Close()
+
+	db.AddView(NewView("raw",
+		func(em Emitter, id string, doc interface{}) {
+			c, ok := doc.(*comment)
+			if !ok {
+				return
+			}
+			em.Emit([]byte(c.Text), []byte(id))
+		}))
+
+	ids := []string{"https://example.com/a?b=c&d", "a.b.c", "x^y", "<>", "\x00zero"}
+	var list []interface{}
+	for _, id := range ids {
+		list = append(list, &comment{ID: id, Text: "^key\x00" + id})
+	}
+	require.NoError(db.Put(list...))
+	for _, c := range list {
+		require.NoError(db.Put(c))
+	}
+
+	for _, id := range ids {
+		var res []comment
+		require.NoError(db.Get(&res, id))
+		require.Equal(id, res[0].ID)
+
+		vk := []byte("^key\x00" + id)
+		l, _, err := db.Query(Q{View: "raw", Start: vk, Prefix: vk})
+		require.NoError(err)
+		require.Equal(1, len(l))
+		require.Equal(id, string(l[0].Key))
+		require.Equal(id, string(l[0].Val))
+		require.Equal(vk, l[0].Index)
+	}
+
+	l, _, err := db.Query(Q{View: "raw", Prefix: []byte("^key")})
+	require.NoError(err)
+	require.Equal(len(ids), len(l))
+
+	require.NoError(db.Delete(ids...))
+	l, _, err = db.Query(Q{View: "raw"})
+	require.NoError(err)
+	require.Equal(0, len(l))
+}
+
+func TestMigrateKeys(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB()
+	defer db.Close()
+
+	// write documents and views in format 1
+	hash := string(fnvhash([]byte("tags")))
+	seqHash := string(fnvhash([]byte(viewdbseq)))
+	legacy := func(txn *badger.Txn, hash, id, viewKey string, val []byte) {
+		x2k := viewsp + hash + legacyx2k + viewsp + viewKey + viewsp + id
+		k2x := viewsp + hash + legacyk2x + viewsp + id + viewsp + viewKey
+		require.NoError(txn.Set([]byte(k2x), []byte(x2k)))
+		require.NoError(txn.Set([]byte(x2k), val))
+	}
+	require.NoError(db.db.Update(func(txn *badger.Txn) error {
+		require.NoError(txn.Delete([]byte(pat4Sys(keyformat))))
+		for i, id := range []string{"C1", "C10"} {
+			rev := fmt.Sprintf("%016x", i)
+			js := fmt.Sprintf(`{"id":%q,"rev":%q,"tags":["a^b","c"]}`, id, rev)
+			require.NoError(txn.Set([]byte(pat4Key(id)), []byte(js)))
+			legacy(txn, seqHash, id, rev, nil)
+			legacy(txn, hash, id, "a^b", []byte("V"))
+			legacy(txn, hash, id, "c", nil)
+		}
+		legacy(txn, string(fnvhash([]byte("gone"))), "C1", "x", nil)
+		return nil
+	}))
+
+	// as done by Open
+	require.NoError(migrateKeys(db.db))
+	require.NoError(migrateKeys(db.db))
+
+	infos, err := db.Views()
+	require.NoError(err)
+	require.Equal(2, len(infos))
+	unnamed := map[string]bool{}
+	for _, info := range infos {
+		require.False(info.Registered)
+		unnamed[info.Name] = true
+	}
+	require.True(unnamed[unnamedView(hash)])
+	require.True(unnamed[unnamedView(string(fnvhash([]byte("gone"))))])
+	n, err := db.Changes("", 0)
+	require.NoError(err)
+	require.Equal(2, len(n))
+
+	require.NoError(db.AddView(NewView("tags",
+		func(em Emitter, id string, doc interface{}) {
+			c, ok := doc.(*comment)
+			if !ok {
+				return
+			}
+			for _, v := range c.Tags {
+				em.Emit([]byte(v), nil)
+			}
+		})))
+
+	l, _, err := db.Query(Q{View: "tags", Start: []byte("a^b"), Prefix: []byte("a^b")})
+	require.NoError(err)
+	require.Equal(2, len(l))
+	require.Equal("C1", string(l[0].Key))
+	require.Equal("V", string(l[0].Val))
+	require.Equal("C10", string(l[1].Key))
+
+	var res []comment
+	require.NoError(db.Get(&res, "C1"))
+	c := &res[0]
+	c.Tags = []string{"d"}
+	require.NoError(db.Put(c))
+	l, _, err = db.Query(Q{View: "tags"})
+	require.NoError(err)
+	require.Equal(3, len(l))
+
+	infos, err = db.Views()
+	require.NoError(err)
+	require.Equal(2, len(infos))
+	for i := range infos {
+		require.True(infos[i].Size > 0)
+		infos[i].Size, infos[i].ID = 0, 0
+	}
+	require.Equal(ViewInfo{Name: unnamedView(string(fnvhash([]byte("gone")))), Entries: 1}, infos[0])
+	require.Equal(ViewInfo{Name: "tags", Registered: true, Entries: 3}, infos[1])
+
+	require.NoError(db.DeleteOrphanViews())
+	infos, err = db.Views()
+	require.NoError(err)
+	require.Equal(1, len(infos))
+	all, err := db.unboundAll()
+	require.NoError(err)
+	for _, kv := range all {
+		// no key of format 1 is left
+		if bytes.HasPrefix(kv.Key, []byte(viewsp)) && len(kv.Key) > 2+fnvsize {
+			require.NotContains([]string{legacyk2x + viewsp, legacyx2k + viewsp}, string(kv.Key[1+fnvsize:3+fnvsize]))
+		}
+	}
+}
+
+func TestViewCatalog(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB()
+	defer db.Close()
+
+	emitText := func(em Emitter, id string, doc interface{}) {
+		if c, ok := doc.(*comment); ok {
+			em.Emit([]byte(c.Text), nil)
+		}
+	}
+	require.NoError(db.AddView(NewView("first", emitText)))
+	require.NoError(db.AddView(NewView("second", emitText)))
+	require.NoError(db.Put(&comment{ID: "C1", Text: "T1"}, &comment{ID: "C2", Text: "T2"}))
+
+	infos, err := db.Views()
+	require.NoError(err)
+	stats, err := db.Stats()
+	require.NoError(err)
+	for i := range infos {
+		require.True(infos[i].Size > 0)
+		require.Equal(stats.Views[infos[i].Name].Size, infos[i].Size)
+		infos[i].Size = 0
+	}
+	require.Equal([]ViewInfo{
+		{Name: "first", ID: 1, Registered: true, Entries: 2},
+		{Name: "second", ID: 2, Registered: true, Entries: 2},
+	}, infos)
+
+	// "second" is not registered anymore, as if the database is opened again
+	db.views = db.views[:1]
+	infos, err = db.Views()
+	require.NoError(err)
+	require.False(infos[1].Registered)
+	l, _, err := db.Query(Q{View: "second"})
+	require.NoError(err)
+	require.Equal(2, len(l))
+
+	require.NoError(db.DeleteOrphanViews())
+	infos, err = db.Views()
+	require.NoError(err)
+	infos[0].Size = 0
+	require.Equal([]ViewInfo{{Name: "first", ID: 1, Registered: true, Entries: 2}}, infos)
+	l, _, err = db.Query(Q{View: "second"})
+	require.NoError(err)
+	require.Equal(0, len(l))
+
+	// a new view never reuses an id
+	require.NoError(db.AddView(NewView("third", emitText)))
+	require.Equal(encodeNS(3), db.views[1].ns)
+}
+
+func TestUniqueView(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB()
+	defer db.Close()
+
+	require.NoError(db.AddView(NewUniqueView("email",
+		func(em Emitter, id string, doc interface{}) {
+			if c, ok := doc.(*comment); ok && c.By != "" {
+				em.Emit([]byte(c.By), nil)
+			}
+		})))
+
+	c1 := &comment{ID: "C1", By: "frodo@shire"}
+	require.NoError(db.Put(c1))
+	require.NoError(db.Put(c1))
+
+	err := db.Put(&comment{ID: "C2", Text: "fine"}, &comment{ID: "C3", By: "frodo@shire"})
+	require.True(errors.Is(err, ErrUniqueViolation))
+	var violation *UniqueViolation
+	require.True(errors.As(err, &violation))
+	require.Equal("email", violation.View)
+	require.Equal("frodo@shire", string(violation.Key))
+	require.Equal("C3", violation.ID)
+	require.Equal("C1", violation.Owner)
+	var res []comment
+	require.Equal(ErrNotFound, db.Get(&res, "C2"))
+
+	err = db.Put(&comment{ID: "C4", By: "sam@shire"}, &comment{ID: "C5", By: "sam@shire"})
+	require.True(errors.As(err, &violation))
+	require.Equal("C4", violation.Owner)
+
+	// changing the key frees the old one
+	c1.By = "frodo@rivendell"
+	require.NoError(db.Put(c1))
+	require.NoError(db.Put(&comment{ID: "C3", By: "frodo@shire"}))
+
+	// deleting the document frees the key
+	require.NoError(db.Delete("C1"))
+	require.NoError(db.Put(&comment{ID: "C6", By: "frodo@rivendell"}))
+
+	l, _, err := db.Query(Q{View: "email"})
+	require.NoError(err)
+	require.Equal(2, len(l))
+	require.Equal("C6", string(l[0].Key))
+	require.Equal("C3", string(l[1].Key))
+}
+
+func TestQueryKeys(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB()
+	defer db.Close()
+
+	require.NoError(db.AddView(NewView("tags",
+		func(em Emitter, id string, doc interface{}) {
+			c, ok := doc.(*comment)
+			if !ok {
+				return
+			}
+			for _, v := range c.Tags {
+				em.Emit([]byte(v), nil)
+			}
+		})))
+
+	require.NoError(db.Put(
+		&comment{ID: "C1", Tags: []string{"go", "golang", "db"}},
+		&comment{ID: "C2", Tags: []string{"go"}},
+		&comment{ID: "C3", Tags: []string{"rust", "db"}},
+		&comment{ID: "C4", Tags: []string{"zig"}}))
+
+	l, cnt, err := db.Query(Q{View: "tags", Keys: [][]byte{[]byte("db"), []byte("none"), []byte("go")}})
+	require.NoError(err)
+	require.Equal(4, cnt)
+	var got []string
+	for _, r := range l {
+		got = append(got, fmt.Sprintf("%d %s %s", r.Group, r.Index, r.Key))
+	}
+	require.Equal([]string{"0 db C1", "0 db C3", "2 go C1", "2 go C2"}, got)
+
+	l, _, err = db.Query(Q{
+		View:     "tags",
+		Keys:     [][]byte{[]byte("db")},
+		Ranges:   []Range{{Prefix: []byte("go")}, {Start: []byte("r"), End: []byte("zz")}},
+		Distinct: true,
+	})
+	require.NoError(err)
+	got = nil
+	for _, r := range l {
+		got = append(got, fmt.Sprintf("%d %s %s", r.Group, r.Index, r.Key))
+	}
+	require.Equal([]string{"0 db C1", "0 db C3", "1 go C2", "2 zig C4"}, got)
+
+	l, _, err = db.Query(Q{View: "tags", Ranges: []Range{{Prefix: []byte("go")}, {Prefix: []byte("db")}}, Limit: 4})
+	require.NoError(err)
+	require.Equal(4, len(l))
+	require.Equal(0, l[2].Group)
+	require.Equal(1, l[3].Group)
+
+	_, cnt, err = db.Query(Q{View: "tags", Keys: [][]byte{[]byte("db"), []byte("go")}, Distinct: true, Count: true})
+	require.NoError(err)
+	require.Equal(3, cnt)
+
+	l, _, err = db.Query(Q{Keys: [][]byte{[]byte("C3"), []byte("C"), []byte("C1")}})
+	require.NoError(err)
+	require.Equal(2, len(l))
+	require.Equal("C3", string(l[0].Key))
+	require.Equal(2, l[1].Group)
+}
+
 func TestInspector(t *testing.T) {
 	require := require.New(t)
 
@@ -415,90 +771,1654 @@ func TestInspector(t *testing.T) {
 	require.Equal("R-100", ins.rev.Value())
 }
 
-func TestGet2(t *testing.T) {
+type tagged struct {
+	Key     string `json:"key,omitempty" dockage:"id"`
+	Version string `json:"version" dockage:"rev"`
+	ID      string `json:"id"`
+}
+
+type Mommy struct {
+	*Granny
+	Text string `json:"text,omitempty"`
+}
+
+func TestInspectorTags(t *testing.T) {
 	require := require.New(t)
-	db := createDB()
-	defer db.Close()
 
-	var list []interface{}
-	var ids []string
-	for i := 1; i <= 3; i++ {
-		cmnt := &comment{
-			ID:   fmt.Sprintf("CMNT::%03d", i),
-			By:   "Frodo Baggins",
-			Text: "Hi!",
-			At:   time.Now(),
-			Tags: []string{"tech", "golang"},
-		}
-		list = append(list, cmnt)
-		ids = append(ids, cmnt.ID)
+	type omitted struct {
+		ID  string `json:"id,omitempty"`
+		Rev string `json:"rev,omitempty"`
 	}
-	require.NoError(db.Put(list...))
 
-	var result []comment
-	require.NoError(db.Get(&result, ids[0], ids[1:]...))
-	require.Equal(3, len(result))
-	for _, v := range result {
-		require.Equal("Frodo Baggins", v.By)
-	}
+	ins := new(inspector)
+	require.NoError(ins.inspect(&omitted{ID: "100"}))
+	require.Equal("100", ins.id)
+	require.NotNil(ins.rev)
+
+	ins = new(inspector)
+	require.NoError(ins.inspect(&tagged{Key: "K-100", ID: "100"}))
+	require.Equal("K-100", ins.id)
+	require.NoError(ins.rev.Set("R-100"))
+	require.Equal("Version", ins.rev.Name())
+
+	m := &Mommy{Granny: &Granny{ID: "100"}}
+	ins = new(inspector)
+	require.NoError(ins.inspect(m))
+	require.Equal("100", ins.id)
+	require.NoError(ins.rev.Set("R-100"))
+	require.Equal("R-100", m.Rev)
+
+	ins = new(inspector)
+	require.NoError(ins.inspect(&Mommy{}))
+	require.Equal("", ins.id)
+	require.Nil(ins.rev)
 }
 
-func TestGetDifferentDocs(t *testing.T) {
+func TestInspectorInvalidID(t *testing.T) {
 	require := require.New(t)
-	db := createDB()
-	defer db.Close()
 
-	var clist []interface{}
-	var cids []string
-	for i := 1; i <= 3; i++ {
-		cmnt := &comment{
-			ID:   fmt.Sprintf("CMNT::%03d", i),
-			By:   "Frodo Baggins",
-			Text: "Hi!",
-			At:   time.Now(),
-			Tags: []string{"tech", "golang"},
-		}
-		clist = append(clist, cmnt)
-		cids = append(cids, cmnt.ID)
+	type numbered struct {
+		ID  int    `json:"id"`
+		Rev string `json:"rev"`
 	}
-	require.NoError(db.Put(clist...))
 
-	type post struct {
-		ID     string `json:"id"`
-		Rev    string `json:"rev"`
-		Author string `json:"by,omitempty"`
-		Text   string `json:"text,omitempty"`
+	ins := new(inspector)
+	err := ins.inspect(&numbered{ID: 1})
+	require.True(errors.Is(err, ErrInvalidIDType))
+
+	require.True(errors.Is(db.Put(&numbered{ID: 1}), ErrInvalidIDType))
+	require.Equal(ErrNoID, db.Put(map[string]interface{}{"id": "1"}))
+
+	// a dockage tag takes over, even after a json tag of another type
+	type overridden struct {
+		Num int    `json:"id"`
+		Rev int    `json:"rev"`
+		Key string `json:"key" dockage:"id"`
+		Ver string `json:"ver" dockage:"rev"`
 	}
+	ins = new(inspector)
+	require.NoError(ins.inspect(&overridden{Num: 1, Rev: 2, Key: "K1"}))
+	require.Equal("K1", ins.id)
+	require.Equal("Ver", ins.rev.Name())
 
-	var plist []interface{}
-	var pids []string
-	for i := 1; i <= 3; i++ {
-		p := &post{
-			ID:     fmt.Sprintf("POST::%03d", i),
-			Author: "Ta Da!",
-			Text:   "Hya!",
-		}
-		plist = append(plist, p)
-		pids = append(pids, p.ID)
+	// and from an embedded struct
+	type Base struct {
+		Key string `dockage:"id"`
 	}
-	require.NoError(db.Put(plist...))
-
-	// get documents of different types different
-	var result = []interface{}{
-		&comment{},
-		&post{},
+	type outer struct {
+		Base
+		Num int `json:"id"`
 	}
-	require.NoError(db.Get(&result, "CMNT::001", "POST::002"))
-	require.Equal(2, len(result))
-	for _, v := range result {
-		switch x := v.(type) {
-		case *comment:
-			require.Equal("Frodo Baggins", x.By)
-		case *post:
-			require.Equal("Ta Da!", x.Author)
-			require.Equal("Hya!", x.Text)
-		default:
-			require.Failf("UNKNOWN TYPE", fmt.Sprintf("%T", v))
-		}
+	ins = new(inspector)
+	require.NoError(ins.inspect(&outer{Base: Base{Key: "K2"}, Num: 1}))
+	require.Equal("K2", ins.id)
+}
+
+func TestPutTagged(t *testing.T) {
+	require := require.New(t)
+
+	d := &tagged{Key: "TAGGED:001"}
+	require.NoError(db.Put(d))
+	require.NotEmpty(d.Version)
+
+	var res []tagged
+	require.NoError(db.Get(&res, "TAGGED:001"))
+	require.Equal(1, len(res))
+	require.Equal(d.Version, res[0].Version)
+
+	require.NoError(db.Delete("TAGGED:001"))
+}
+
+func TestUUIDGenerator(t *testing.T) {
+	require := require.New(t)
+
+	gen := NewUUIDGenerator()
+	id1, err := gen.NextID(nil)
+	require.NoError(err)
+	id2, err := gen.NextID(nil)
+	require.NoError(err)
+	require.NotEqual(id1, id2)
+	require.Len(id1, 36)
+	require.Equal(byte('4'), id1[14])
+}
+
+func TestULIDGenerator(t *testing.T) {
+	require := require.New(t)
+
+	at := time.Date(2018, 5, 20, 0, 0, 0, 0, time.UTC)
+	gen := &ulidGenerator{now: func() time.Time { return at }}
+	var prev string
+	for i := 0; i < 100; i++ {
+		id, err := gen.NextID(nil)
+		require.NoError(err)
+		require.Len(id, 26)
+		require.True(id > prev)
+		prev = id
 	}
+	at = at.Add(time.Millisecond)
+	id, err := gen.NextID(nil)
+	require.NoError(err)
+	require.True(id > prev)
+	require.Equal("01CDXDH101", id[:10])
+
+	require.Equal("00000000000000000000000001", encodeULID([16]byte{15: 1}))
+	require.Equal("7ZZZZZZZZZZZZZZZZZZZZZZZZZ", encodeULID([16]byte{
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}))
+}
+
+func TestPutGeneratedID(t *testing.T) {
+	require := require.New(t)
+
+	db := createDBWith(Options{IDGenerator: NewSequenceIDGenerator("CMNT:")})
+	defer db.Close()
+
+	c1, c2 := &comment{Text: "first"}, &comment{Text: "second"}
+	require.NoError(db.Put(c1, c2))
+	require.Equal("CMNT:0000000000000000", c1.ID)
+	require.Equal("CMNT:0000000000000001", c2.ID)
+
+	var res []comment
+	require.NoError(db.Get(&res, c1.ID, c2.ID))
+	require.Equal("first", res[0].Text)
+	require.Equal(c2.ID, res[1].ID)
+
+	require.True(errors.Is(db.Put(comment{Text: "by value"}), ErrIDNotSettable))
+
+	type norev struct {
+		Text string `json:"text"`
+	}
+	require.Equal(ErrNoID, db.Put(&norev{}))
+}
+
+func TestFieldView(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB()
+	defer db.Close()
+
+	type author struct {
+		Name string `json:"name"`
+	}
+	type book struct {
+		ID     string   `json:"id"`
+		Rev    string   `json:"rev"`
+		Author author   `json:"author"`
+		Year   int      `json:"year"`
+		Tags   []string `json:"tags,omitempty"`
+	}
+
+	db.AddView(NewFieldView("author", "author.name"))
+	db.AddView(NewFieldView("author-year", "author.name", "year"))
+	db.AddView(NewFieldView("tags", "tags"))
+
+	require.NoError(db.Put(
+		&book{ID: "B1", Author: author{"Tolkien"}, Year: 1954, Tags: []string{"fantasy", "epic"}},
+		&book{ID: "B2", Author: author{"Tolkien"}, Year: 1937, Tags: []string{"fantasy"}},
+		&book{ID: "B3", Author: author{"Herbert"}, Year: -94},
+		&comment{ID: "C1", Text: "not a book"}))
+
+	tolkien, err := keys.Encode("Tolkien")
+	require.NoError(err)
+	l, _, err := db.Query(Q{View: "author", Start: tolkien, Prefix: tolkien})
+	require.NoError(err)
+	require.Equal(2, len(l))
+	require.Equal("B1", string(l[0].Key))
+	require.Equal(tolkien, l[0].Index)
+	idx, err := keys.Decode(l[0].Index)
+	require.NoError(err)
+	require.Equal([]interface{}{"Tolkien"}, idx)
+
+	l, _, err = db.Query(Q{View: "author-year"})
+	require.NoError(err)
+	require.Equal(3, len(l))
+	require.Equal("B3", string(l[0].Key))
+	require.Equal("B2", string(l[1].Key))
+	require.Equal("B1", string(l[2].Key))
+
+	fantasy, _ := keys.Encode("fantasy")
+	l, _, err = db.Query(Q{View: "tags", Start: fantasy, Prefix: fantasy})
+	require.NoError(err)
+	require.Equal(2, len(l))
+
+	require.NoError(db.Delete("B1"))
+	l, _, err = db.Query(Q{View: "tags"})
+	require.NoError(err)
+	require.Equal(1, len(l))
+	require.Equal("B2", string(l[0].Key))
+
+	require.NoError(db.DeleteView("author-year"))
+	l, _, err = db.Query(Q{View: "author-year"})
+	require.NoError(err)
+	require.Equal(0, len(l))
+
+	require.NoError(db.RebuildView("author-year"))
+	l, _, err = db.Query(Q{View: "author-year"})
+	require.NoError(err)
+	require.Equal(2, len(l))
+	require.Equal("B3", string(l[0].Key))
+
+	caret, _ := keys.Encode("x^y")
+	require.NoError(db.Put(&book{ID: "B5", Author: author{"x^y"}}))
+	l, _, err = db.Query(Q{View: "author", Start: caret, Prefix: caret})
+	require.NoError(err)
+	require.Equal(1, len(l))
+	require.Equal("B5", string(l[0].Key))
+	require.Equal(caret, l[0].Index)
+
+	require.Equal(ErrViewNotFound, db.RebuildView("nope"))
+	db.AddView(NewView("go-view", func(Emitter, string, interface{}) {}))
+	require.Equal(ErrViewNotRebuildable, db.RebuildView("go-view"))
+}
+
+func TestRebuildViewBatches(t *testing.T) {
+	require := require.New(t)
+
+	db, err := Open(Options{InMemory: true, GCInterval: -1})
+	require.NoError(err)
+	defer db.Close()
+
+	n := 2*rebuildBatch + 10
+	var docs []interface{}
+	for i := 0; i < n; i++ {
+		docs = append(docs, &comment{ID: fmt.Sprintf("C%05d", i), By: fmt.Sprint(i % 7)})
+		if len(docs) == 500 {
+			require.NoError(db.Put(docs...))
+			docs = nil
+		}
+	}
+	require.NoError(db.Put(docs...))
+	require.NoError(db.AddView(NewFieldView("by", "by")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Equal(context.Canceled, db.RebuildViewContext(ctx, "by"))
+
+	require.NoError(db.RebuildView("by"))
+	_, count, err := db.Query(Q{View: "by", Count: true})
+	require.NoError(err)
+	require.Equal(n, count)
+	s, err := db.Stats()
+	require.NoError(err)
+	require.Equal(n, s.Views["by"].Entries)
+	require.NoError(db.RebuildView("by"))
+	s, err = db.Stats()
+	require.NoError(err)
+	require.Equal(n, s.Views["by"].Entries)
+}
+
+func TestGet2(t *testing.T) {
+	require := require.New(t)
+	db := createDB()
+	defer db.Close()
+
+	var list []interface{}
+	var ids []string
+	for i := 1; i <= 3; i++ {
+		cmnt := &comment{
+			ID:   fmt.Sprintf("CMNT::%03d", i),
+			By:   "Frodo Baggins",
+			Text: "Hi!",
+			At:   time.Now(),
+			Tags: []string{"tech", "golang"},
+		}
+		list = append(list, cmnt)
+		ids = append(ids, cmnt.ID)
+	}
+	require.NoError(db.Put(list...))
+
+	var result []comment
+	require.NoError(db.Get(&result, ids[0], ids[1:]...))
+	require.Equal(3, len(result))
+	for _, v := range result {
+		require.Equal("Frodo Baggins", v.By)
+	}
+}
+
+func TestGetDifferentDocs(t *testing.T) {
+	require := require.New(t)
+	db := createDB()
+	defer db.Close()
+
+	var clist []interface{}
+	var cids []string
+	for i := 1; i <= 3; i++ {
+		cmnt := &comment{
+			ID:   fmt.Sprintf("CMNT::%03d", i),
+			By:   "Frodo Baggins",
+			Text: "Hi!",
+			At:   time.Now(),
+			Tags: []string{"tech", "golang"},
+		}
+		clist = append(clist, cmnt)
+		cids = append(cids, cmnt.ID)
+	}
+	require.NoError(db.Put(clist...))
+
+	type post struct {
+		ID     string `json:"id"`
+		Rev    string `json:"rev"`
+		Author string `json:"by,omitempty"`
+		Text   string `json:"text,omitempty"`
+	}
+
+	var plist []interface{}
+	var pids []string
+	for i := 1; i <= 3; i++ {
+		p := &post{
+			ID:     fmt.Sprintf("POST::%03d", i),
+			Author: "Ta Da!",
+			Text:   "Hya!",
+		}
+		plist = append(plist, p)
+		pids = append(pids, p.ID)
+	}
+	require.NoError(db.Put(plist...))
+
+	// get documents of different types different
+	var result = []interface{}{
+		&comment{},
+		&post{},
+	}
+	require.NoError(db.Get(&result, "CMNT::001", "POST::002"))
+	require.Equal(2, len(result))
+	for _, v := range result {
+		switch x := v.(type) {
+		case *comment:
+			require.Equal("Frodo Baggins", x.By)
+		case *post:
+			require.Equal("Ta Da!", x.Author)
+			require.Equal("Hya!", x.Text)
+		default:
+			require.Failf("UNKNOWN TYPE", fmt.Sprintf("%T", v))
+		}
+	}
+}
+
+func TestQueryCond(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB()
+	defer db.Close()
+
+	require.NoError(db.AddView(NewView("tags",
+		func(em Emitter, id string, doc interface{}) {
+			c, ok := doc.(*comment)
+			if !ok {
+				return
+			}
+			for _, v := range c.Tags {
+				em.Emit([]byte(v), nil)
+			}
+		})))
+	require.NoError(db.AddView(NewView("by",
+		func(em Emitter, id string, doc interface{}) {
+			c, ok := doc.(*comment)
+			if !ok || c.By == "" {
+				return
+			}
+			em.Emit([]byte(c.By), nil)
+		})))
+
+	require.NoError(db.Put(
+		&comment{ID: "C1", By: "dc0d", Tags: []string{"go", "golang", "db"}},
+		&comment{ID: "C2", By: "dc0d", Tags: []string{"go"}},
+		&comment{ID: "C3", By: "rob", Tags: []string{"rust", "db"}},
+		&comment{ID: "C4", By: "rob", Tags: []string{"go"}},
+		&comment{ID: "C5", Tags: []string{"zig"}}))
+
+	ids := func(cond Cond, params CondQ) (resids []string) {
+		l, _, err := db.QueryCond(cond, params)
+		require.NoError(err)
+		for _, r := range l {
+			resids = append(resids, string(r.Key))
+		}
+		return
+	}
+
+	tags := func(k string) Q { return Q{View: "tags", Keys: [][]byte{[]byte(k)}} }
+	by := func(k string) Q { return Q{View: "by", Keys: [][]byte{[]byte(k)}} }
+
+	require.Equal([]string{"C1", "C2"}, ids(And(tags("go"), by("dc0d")), CondQ{}))
+	require.Equal([]string{"C1", "C3", "C5"}, ids(Or(tags("db"), tags("zig")), CondQ{}))
+	require.Equal([]string{"C2", "C4"}, ids(And(tags("go"), Not(tags("db"))), CondQ{}))
+	require.Equal([]string{"C5"}, ids(Not(Q{View: "by", Prefix: []byte("")}), CondQ{}))
+	require.Equal([]string{"C3", "C4", "C5"}, ids(Not(by("dc0d")), CondQ{}))
+	require.Equal([]string{"C1", "C3", "C4"}, ids(Or(And(by("rob")), And(tags("golang"))), CondQ{}))
+	require.Empty(ids(And(tags("go"), Q{View: "unknown"}), CondQ{}))
+
+	cond := Or(tags("go"), tags("db"))
+	require.Equal([]string{"C1", "C2"}, ids(cond, CondQ{Limit: 2}))
+	require.Equal([]string{"C3", "C4"}, ids(cond, CondQ{Limit: 2, After: "C2"}))
+	require.Empty(ids(cond, CondQ{Limit: 2, After: "C4"}))
+
+	_, cnt, err := db.QueryCond(cond, CondQ{Count: true, After: "C1"})
+	require.NoError(err)
+	require.Equal(3, cnt)
+
+	l, _, err := db.QueryCond(And(by("rob"), tags("rust")), CondQ{})
+	require.NoError(err)
+	require.Equal(1, len(l))
+	require.Contains(string(l[0].Val), `"id":"C3"`)
+}
+
+func TestFind(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB()
+	defer db.Close()
+
+	at := func(s string) time.Time {
+		v, err := time.Parse("2006-01-02", s)
+		require.NoError(err)
+		return v
+	}
+	require.NoError(db.Put(
+		&comment{ID: "C1", By: "Frodo", At: at("2018-05-19"), Tags: []string{"golang", "db"}},
+		&comment{ID: "C2", By: "Frodo", At: at("2018-05-21"), Tags: []string{"golang"}},
+		&comment{ID: "C3", By: "Frodo", At: at("2018-05-22"), Tags: []string{"rust"}},
+		&comment{ID: "C4", By: "Sam", At: at("2018-05-23"), Tags: []string{"golang", "db"}},
+		&comment{ID: "C5", By: "Sam", Text: "no tags"}))
+
+	find := func(selector interface{}) (resids []string) {
+		l, err := db.Find(selector, FindOptions{})
+		require.NoError(err)
+		for _, r := range l {
+			resids = append(resids, string(r.Key))
+		}
+		return
+	}
+
+	selector := `{"by": "Frodo", "at": {"$gte": "2018-05-20"}, "tags": {"$in": ["golang"]}}`
+	check := func() {
+		require.Equal([]string{"C2"}, find(selector))
+		require.Equal([]string{"C1", "C4"}, find(map[string]interface{}{"tags": "db"}))
+		require.Equal([]string{"C3", "C4"}, find(`{"at": {"$gt": "2018-05-21T23", "$lte": "2018-05-24"}}`))
+		require.Equal([]string{"C1", "C2"}, find(`{"at": {"$lt": "2018-05-22"}, "by": {"$ne": "Sam"}}`))
+		require.Equal([]string{"C3", "C5"}, find(`{"tags": {"$nin": ["golang"]}}`))
+		require.Equal([]string{"C5"}, find(`{"tags": {"$exists": false}}`))
+		require.Equal([]string{"C3", "C5"}, find(`{"$or": [{"tags": "rust"}, {"text": {"$exists": true}}]}`))
+		require.Equal([]string{"C4"}, find(`{"$and": [{"by": "Sam"}, {"tags": {"$in": ["db", "rust"]}}]}`))
+		require.Empty(find(`{"by": {"$gt": 1}}`))
+
+		l, err := db.Find(`{"by": {"$in": ["Frodo", "Sam"]}}`, FindOptions{Skip: 1, Limit: 2})
+		require.NoError(err)
+		require.Equal(2, len(l))
+		require.Equal("C2", string(l[0].Key))
+		require.Equal("C3", string(l[1].Key))
+	}
+
+	plan, err := db.Explain(selector)
+	require.NoError(err)
+	require.True(plan.FullScan())
+	require.Equal("full scan of documents", plan.String())
+	check()
+
+	db.AddView(NewFieldView("at", "at"))
+	db.AddView(NewFieldView("by-at", "by", "at"))
+	db.AddView(NewFieldView("tags", "tags"))
+	require.NoError(db.RebuildView("at"))
+	require.NoError(db.RebuildView("by-at"))
+	require.NoError(db.RebuildView("tags"))
+
+	plan, err = db.Explain(selector)
+	require.NoError(err)
+	require.Equal(Plan{View: "by-at", Field: "by", Op: "$eq"}, plan)
+
+	plan, err = db.Explain(`{"at": {"$gt": "2018-05-21T23", "$lte": "2018-05-24"}, "tags": {"$ne": "db"}}`)
+	require.NoError(err)
+	require.Equal("view at: at $range", plan.String())
+
+	plan, err = db.Explain(`{"tags": {"$in": ["db"]}, "at": {"$gt": "2018-05-21"}}`)
+	require.NoError(err)
+	require.Equal("tags", plan.View)
+	check()
+
+	_, err = db.Find(`{"by": {"$regex": "F"}}`, FindOptions{})
+	require.True(errors.Is(err, ErrInvalidSelector))
+	_, err = db.Find(`[1]`, FindOptions{})
+	require.True(errors.Is(err, ErrInvalidSelector))
+}
+
+func TestFindMultiPathView(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB()
+	defer db.Close()
+	require.NoError(db.AddView(NewFieldView("by-at", "by", "at")))
+
+	type doc struct {
+		ID  string `json:"id"`
+		Rev string `json:"rev"`
+		By  string `json:"by"`
+		At  string `json:"at,omitempty"`
+	}
+	require.NoError(db.Put(&doc{ID: "D1", By: "Frodo", At: "2018"}, &doc{ID: "D2", By: "Frodo"}))
+
+	// D2 is not in the view, which must not be used
+	plan, err := db.Explain(`{"by": "Frodo"}`)
+	require.NoError(err)
+	require.Equal(Plan{}, plan)
+	l, err := db.Find(`{"by": "Frodo"}`, FindOptions{})
+	require.NoError(err)
+	require.Equal(2, len(l))
+
+	// $exists does not need a value; an empty array exists
+	plan, err = db.Explain(`{"by": "Frodo", "at": {"$exists": true}}`)
+	require.NoError(err)
+	require.Equal(Plan{}, plan)
+
+	plan, err = db.Explain(`{"by": "Frodo", "at": {"$gte": "2000"}}`)
+	require.NoError(err)
+	require.Equal(Plan{View: "by-at", Field: "by", Op: "$eq"}, plan)
+	l, err = db.Find(`{"by": "Frodo", "at": {"$gte": "2000"}}`, FindOptions{})
+	require.NoError(err)
+	require.Equal(1, len(l))
+	require.Equal("D1", string(l[0].Key))
+}
+
+func TestFindArrays(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB()
+	defer db.Close()
+
+	type doc struct {
+		ID   string        `json:"id"`
+		Rev  string        `json:"rev"`
+		Tags []interface{} `json:"tags"`
+	}
+	require.NoError(db.Put(
+		&doc{ID: "A1", Tags: []interface{}{"a", "b"}},
+		&doc{ID: "A2", Tags: []interface{}{}},
+		&doc{ID: "A3", Tags: []interface{}{[]interface{}{"a", "b"}, "c"}},
+		&doc{ID: "A4"}))
+
+	find := func(selector string) (resids []string) {
+		l, err := db.Find(selector, FindOptions{})
+		require.NoError(err)
+		for _, r := range l {
+			resids = append(resids, string(r.Key))
+		}
+		return
+	}
+	require.Equal([]string{"A1", "A3"}, find(`{"tags": {"$eq": ["a", "b"]}}`))
+	require.Equal([]string{"A1"}, find(`{"tags": "a"}`))
+	require.Equal([]string{"A2"}, find(`{"tags": []}`))
+	require.Equal([]string{"A2", "A3", "A4"}, find(`{"tags": {"$ne": "a"}}`))
+	require.Equal([]string{"A2", "A4"}, find(`{"tags": {"$ne": ["a", "b"]}}`))
+	require.Equal([]string{"A1", "A3"}, find(`{"tags": {"$in": [["a", "b"], "x"]}}`))
+
+	// presence of the key: an empty array and null exist
+	require.Equal([]string{"A1", "A2", "A3", "A4"}, find(`{"tags": {"$exists": true}}`))
+	require.Empty(find(`{"tags": {"$exists": false}}`))
+	require.Equal([]string{"A1", "A2", "A3", "A4"}, find(`{"missing": {"$exists": false}}`))
+}
+
+func TestAnalyzer(t *testing.T) {
+	require := require.New(t)
+
+	require.Empty(DefaultAnalyzer(" the, a "))
+	require.Equal(
+		[]string{"search", "search", "search", "cafe", "creme", "brulee", "run", "story", "box", "2018"},
+		DefaultAnalyzer("Searching; searched & SEARCHES: Café Crème-Brûlée, running stories boxes (2018)"))
+	require.Equal([]string{"the", "end"}, NewAnalyzer()("The End"))
+}
+
+func TestSearch(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB()
+	defer db.Close()
+
+	require.NoError(db.AddView(NewTextView("text",
+		func(doc interface{}) []string {
+			c, ok := doc.(*comment)
+			if !ok {
+				return nil
+			}
+			return []string{c.Text, strings.Join(c.Tags, " ")}
+		}, nil)))
+
+	require.NoError(db.Put(
+		&comment{ID: "C1", Text: "The quick brown fox jumps over the lazy dog"},
+		&comment{ID: "C2", Text: "A quick search for brown bread", Tags: []string{"fox"}},
+		&comment{ID: "C3", Text: "Searching documents with dockage, a document database"},
+		&comment{ID: "C4", Text: "Brown foxes are quick; quick, quick foxes!"},
+		&comment{ID: "C5", Text: "Nothing to see here"}))
+
+	ids := func(query string) (resids []string) {
+		l, err := db.Search("text", query, 0)
+		require.NoError(err)
+		for _, r := range l {
+			require.True(r.Score > 0)
+			resids = append(resids, r.ID)
+		}
+		return
+	}
+
+	require.Equal([]string{"C4", "C2", "C1"}, ids("quick"))
+	require.Equal([]string{"C4", "C2", "C1"}, ids("FOX"))
+	require.Equal([]string{"C3"}, ids("document"))
+	require.Equal([]string{"C2", "C3"}, ids("search*"))
+	require.Equal([]string{"C3"}, ids("dock*"))
+	require.Equal([]string{"C4", "C1"}, ids(`"brown fox"`))
+	require.Equal([]string{"C1"}, ids(`"lazy dog" "the dog"`))
+	require.Empty(ids(`"bread fox"`))
+	require.Empty(ids("the"))
+	require.Empty(ids("missing"))
+
+	l, err := db.Search("text", "quick", 1)
+	require.NoError(err)
+	require.Equal(1, len(l))
+
+	require.NoError(db.Delete("C4"))
+	require.Equal([]string{"C2", "C1"}, ids("quick"))
+	require.NoError(db.Delete("C1"))
+	require.NoError(db.Put(&comment{ID: "C1", Text: "slow"}))
+	require.Equal([]string{"C2"}, ids("quick"))
+
+	docs, length, err := func() (docs, length int64, err error) {
+		v, _ := db.views.find("text")
+		err = db.db.View(func(txn *badger.Txn) error {
+			docs, length, err = textStats(txn, v.ns)
+			return err
+		})
+		return
+	}()
+	require.NoError(err)
+	require.Equal(int64(4), docs)
+	require.Equal(int64(1+5+5+3), length)
+
+	_, err = db.Search("none", "quick", 0)
+	require.Equal(ErrViewNotFound, err)
+}
+
+type place struct {
+	ID   string     `json:"id"`
+	Rev  string     `json:"rev"`
+	At   [2]float64 `json:"at,omitempty"`
+	Area []float64  `json:"area,omitempty"`
+}
+
+func TestSearchConcurrentWriters(t *testing.T) {
+	require := require.New(t)
+
+	db, err := Open(Options{InMemory: true, GCInterval: -1})
+	require.NoError(err)
+	defer db.Close()
+	require.NoError(db.AddView(NewTextView("text",
+		func(doc interface{}) []string {
+			if c, ok := doc.(*comment); ok {
+				return []string{c.Text}
+			}
+			return nil
+		}, nil)))
+
+	// writers do not share the stats of the view
+	var wg sync.WaitGroup
+	errs := make(chan error, 400)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				errs <- db.Put(&comment{ID: fmt.Sprintf("C%d-%d", g, i), Text: "quick brown fox"})
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(err)
+	}
+
+	docs, length := func() (docs, length int64) {
+		require.NoError(db.db.View(func(txn *badger.Txn) (err error) {
+			vw, _ := db.views.find("text")
+			docs, length, err = textStats(txn, vw.ns)
+			return
+		}))
+		return
+	}()
+	require.Equal(int64(400), docs)
+	require.Equal(int64(1200), length)
+	require.NoError(db.foldCounts())
+	require.NoError(db.Delete("C0-0"))
+	l, err := db.Search("text", "fox", 1000)
+	require.NoError(err)
+	require.Equal(399, len(l))
+	vw, _ := db.views.find("text")
+	require.NoError(db.db.View(func(txn *badger.Txn) error {
+		c, deltas, err := readTextStats(txn, vw.ns, 0)
+		require.Equal(viewCount{399, 1197}, c)
+		require.Equal(1, len(deltas))
+		return err
+	}))
+}
+
+func TestGeoView(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB()
+	defer db.Close()
+
+	require.NoError(db.AddView(NewGeoView("where",
+		func(em GeoEmitter, id string, doc interface{}) {
+			p, ok := doc.(*place)
+			if !ok {
+				return
+			}
+			if len(p.Area) == 4 {
+				em.EmitBox(p.Area[0], p.Area[1], p.Area[2], p.Area[3])
+				return
+			}
+			em.EmitPoint(p.At[0], p.At[1])
+		})))
+
+	require.NoError(db.Put(
+		&place{ID: "tehran", At: [2]float64{35.6892, 51.3890}},
+		&place{ID: "karaj", At: [2]float64{35.8400, 50.9391}},
+		&place{ID: "qom", At: [2]float64{34.6399, 50.8759}},
+		&place{ID: "london", At: [2]float64{51.5074, -0.1278}},
+		&place{ID: "greenwich", At: [2]float64{51.4769, 0.0005}},
+		&place{ID: "iran", Area: []float64{25.0, 44.0, 39.8, 63.3}},
+		&comment{ID: "C1", Text: "not a place"}))
+
+	ids := func(l []GeoRes, err error) (resids []string) {
+		require.NoError(err)
+		for _, r := range l {
+			resids = append(resids, r.ID)
+		}
+		return
+	}
+
+	require.Equal([]string{"iran", "karaj", "tehran"}, ids(db.QueryBox("where", 35, 50.9, 36, 52)))
+	require.Equal([]string{"greenwich", "london"}, ids(db.QueryBox("where", 51, -1, 52, 1)))
+	require.Equal([]string{"greenwich", "iran", "karaj", "london", "qom", "tehran"}, ids(db.QueryBox("where", -90, -180, 90, 180)))
+	require.Empty(ids(db.QueryBox("where", -10, -10, 10, 10)))
+
+	l, err := db.QueryNear("where", 35.6892, 51.3890, 50000, 0)
+	require.NoError(err)
+	require.Equal([]string{"iran", "tehran", "karaj"}, ids(l, err))
+	require.Equal(0.0, l[0].Distance)
+	require.Equal(0.0, l[1].Distance)
+	require.InDelta(43500, l[2].Distance, 1000)
+
+	require.Equal([]string{"iran", "tehran", "karaj", "qom"}, ids(db.QueryNear("where", 35.6892, 51.3890, 150000, 0)))
+	require.Equal([]string{"london", "greenwich"}, ids(db.QueryNear("where", 51.5074, -0.1278, 10000, 0)))
+	require.Equal([]string{"london"}, ids(db.QueryNear("where", 51.5074, -0.1278, 10000, 1)))
+	require.Equal([]string{"london", "greenwich", "iran"}, ids(db.QueryNear("where", 51.5074, -0.1278, 4000000, 0)))
+
+	require.NoError(db.Delete("karaj"))
+	require.Equal([]string{"iran", "tehran"}, ids(db.QueryBox("where", 35, 50.9, 36, 52)))
+
+	err = db.Put(&place{ID: "nowhere", At: [2]float64{91, 0}})
+	require.True(errors.Is(err, ErrInvalidLocation))
+	_, err = db.QueryBox("where", 10, 10, 0, 0)
+	require.True(errors.Is(err, ErrInvalidLocation))
+	_, err = db.QueryNear("none", 0, 0, 1, 0)
+	require.Equal(ErrViewNotFound, err)
+}
+
+type embedded struct {
+	ID  string    `json:"id"`
+	Rev string    `json:"rev"`
+	Vec []float32 `json:"vec,omitempty"`
+}
+
+func TestVectorView(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB()
+	defer db.Close()
+
+	vectorFn := func(em VectorEmitter, id string, doc interface{}) {
+		e, ok := doc.(*embedded)
+		if !ok || e.Vec == nil {
+			return
+		}
+		em.EmitVector(e.Vec)
+	}
+	require.NoError(db.AddView(NewVectorView("exact", vectorFn, nil)))
+	require.NoError(db.AddView(NewVectorView("hnsw", vectorFn, &VectorIndex{Metric: L2, M: 4})))
+
+	rnd := rand.New(rand.NewSource(42))
+	vecs := make(map[string][]float32)
+	var docs []interface{}
+	for i := 0; i < 300; i++ {
+		id := fmt.Sprintf("E%03d", i)
+		v := []float32{rnd.Float32(), rnd.Float32(), rnd.Float32(), rnd.Float32()}
+		vecs[id] = v
+		docs = append(docs, &embedded{ID: id, Vec: v})
+	}
+	require.NoError(db.Put(docs...))
+	require.NoError(db.Put(&comment{ID: "C1", Text: "no vector"}))
+
+	ids := func(l []VectorRes, err error) (resids []string) {
+		require.NoError(err)
+		for _, r := range l {
+			resids = append(resids, r.ID)
+		}
+		return
+	}
+
+	l, err := db.Nearest("exact", []float32{1, 0, 0, 0}, 3, Cosine)
+	require.NoError(err)
+	require.Equal(3, len(l))
+	require.True(l[0].Distance <= l[1].Distance && l[1].Distance <= l[2].Distance)
+
+	l, err = db.Nearest("exact", vecs["E007"], 1, Dot)
+	require.NoError(err)
+	require.True(l[0].Distance <= Dot.distance(vecs["E007"], vecs["E007"]))
+
+	require.Equal([]string{"E042"}, ids(db.Nearest("exact", vecs["E042"], 1, L2)))
+
+	recall := func() float64 {
+		var hits, total int
+		for i := 0; i < 20; i++ {
+			q := []float32{rnd.Float32(), rnd.Float32(), rnd.Float32(), rnd.Float32()}
+			exact := ids(db.NearestExact("hnsw", q, 5, L2))
+			approx := ids(db.Nearest("hnsw", q, 5, L2))
+			for _, id := range exact {
+				total++
+				if contains(approx, id) {
+					hits++
+				}
+			}
+		}
+		return float64(hits) / float64(total)
+	}
+	require.True(recall() >= 0.9)
+	require.Equal([]string{"E042"}, ids(db.Nearest("hnsw", vecs["E042"], 1, L2)))
+
+	var toDelete []string
+	for i := 0; i < 300; i += 3 {
+		toDelete = append(toDelete, fmt.Sprintf("E%03d", i))
+	}
+	require.NoError(db.Delete(toDelete...))
+	require.NoError(db.Put(&embedded{ID: "E042", Vec: []float32{9, 9, 9, 9}}))
+	require.True(recall() >= 0.9)
+	require.Equal([]string{"E042"}, ids(db.Nearest("hnsw", []float32{8, 8, 8, 8}, 1, L2)))
+	for _, id := range ids(db.Nearest("hnsw", vecs["E003"], 10, L2)) {
+		require.False(contains(toDelete, id))
+	}
+
+	err = db.Put(&embedded{ID: "E900", Vec: []float32{1, 2}})
+	require.True(errors.Is(err, ErrInvalidVector))
+	_, err = db.Nearest("exact", []float32{1, 2}, 1, L2)
+	require.True(errors.Is(err, ErrInvalidVector))
+	_, err = db.Nearest("none", []float32{1}, 1, L2)
+	require.Equal(ErrViewNotFound, err)
+
+	// the entry of the graph is only written when it moves
+	hnsw, _ := db.views.find("hnsw")
+	entryVersion := func() (resversion uint64) {
+		require.NoError(db.db.View(func(txn *badger.Txn) error {
+			item, err := txn.Get([]byte(pat4View(hnsw.ns + viewgph + gphEntry)))
+			if err != nil {
+				return err
+			}
+			resversion = item.Version()
+			return nil
+		}))
+		return
+	}
+	version := entryVersion()
+	require.NoError(db.Put(&embedded{ID: "E950", Vec: []float32{0.5, 0.5, 0.5, 0.5}}, &embedded{ID: "E951", Vec: []float32{0.1, 0.2, 0.3, 0.4}}))
+	require.Equal(version, entryVersion())
+	var entry string
+	require.NoError(db.db.View(func(txn *badger.Txn) error {
+		g := newGraph(txn, hnsw.ns, hnsw.vectors)
+		var err error
+		entry, _, _, err = g.entry()
+		return err
+	}))
+	var got []embedded
+	require.NoError(db.Get(&got, entry))
+	got[0].Vec[0] += 0.01
+	require.NoError(db.Put(&got[0]))
+	require.Equal(version, entryVersion())
+
+	// a broken node fails, instead of panicking
+	require.NoError(db.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(pat4View(hnsw.ns+viewgph+gphNode+"E002")), []byte{1, 9, 'x'})
+	}))
+	_, err = db.Nearest("hnsw", vecs["E002"], 300, L2)
+	require.Error(err)
+}
+
+func TestVectorViewLength(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB()
+	defer db.Close()
+
+	require.NoError(db.AddView(NewVectorView("exact", func(em VectorEmitter, id string, doc interface{}) {
+		if e, ok := doc.(*embedded); ok {
+			em.EmitVector(e.Vec)
+		}
+	}, nil)))
+	e1 := &embedded{ID: "E1", Vec: []float32{1, 2, 3}}
+	require.NoError(db.Put(e1))
+	err := db.Put(&embedded{ID: "E2", Vec: []float32{1, 2}})
+	require.True(errors.Is(err, ErrInvalidVector))
+	// a document can change its own vector, if it is the only one
+	e1.Vec = []float32{1, 2}
+	require.NoError(db.Put(e1))
+	require.NoError(db.Put(&embedded{ID: "E2", Vec: []float32{3, 4}}))
+}
+
+func restoreOptions() Options {
+	dir, err := ioutil.TempDir(os.TempDir(), "restore")
+	if err != nil {
+		panic(err)
+	}
+	return Options{Dir: filepath.Join(dir, "index"), ValueDir: filepath.Join(dir, "data")}
+}
+
+func TestBackupRestore(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB()
+	defer db.Close()
+
+	tags := NewView("tags",
+		func(em Emitter, id string, doc interface{}) {
+			c, ok := doc.(*comment)
+			if !ok {
+				return
+			}
+			for _, v := range c.Tags {
+				em.Emit([]byte(v), nil)
+			}
+		})
+	require.NoError(db.AddView(tags))
+
+	require.NoError(db.Put(
+		&comment{ID: "C1", Text: "one", Tags: []string{"go"}},
+		&comment{ID: "C2", Text: "two", Tags: []string{"go", "db"}},
+		&comment{ID: "C3", Text: "three"}))
+
+	var full bytes.Buffer
+	version, err := db.Backup(&full, 0)
+	require.NoError(err)
+	require.True(version > 0)
+
+	c3 := &comment{ID: "C3", Text: "three again", Tags: []string{"db"}}
+	var got []comment
+	require.NoError(db.Get(&got, "C3"))
+	c3.Rev = got[0].Rev
+	require.NoError(db.Put(c3, &comment{ID: "C4", Text: "four", Tags: []string{"db"}}))
+	require.NoError(db.Delete("C1"))
+
+	var incremental bytes.Buffer
+	next, err := db.Backup(&incremental, version)
+	require.NoError(err)
+	require.True(next > version)
+
+	check := func(rdb *DB, ids []string, dbTags []string) {
+		require.NoError(rdb.AddView(tags))
+		l, _, err := rdb.Query(Q{})
+		require.NoError(err)
+		var docs []string
+		for _, r := range l {
+			docs = append(docs, string(r.Key))
+		}
+		require.Equal(ids, docs)
+
+		l, _, err = rdb.Query(Q{View: "tags", Prefix: []byte("db")})
+		require.NoError(err)
+		docs = nil
+		for _, r := range l {
+			docs = append(docs, string(r.Key))
+		}
+		require.Equal(dbTags, docs)
+
+		// the sequence goes on, revs are not reused
+		var last []comment
+		require.NoError(rdb.Get(&last, ids[len(ids)-1]))
+		c := &comment{ID: "C9"}
+		require.NoError(rdb.Put(c))
+		require.True(c.Rev > last[0].Rev)
+	}
+
+	rdb, err := Restore(bytes.NewReader(full.Bytes()), restoreOptions())
+	require.NoError(err)
+	check(rdb, []string{"C1", "C2", "C3"}, []string{"C2"})
+	require.NoError(rdb.Close())
+
+	rdb, err = Restore(io.MultiReader(bytes.NewReader(full.Bytes()), bytes.NewReader(incremental.Bytes())), restoreOptions())
+	require.NoError(err)
+	check(rdb, []string{"C2", "C3", "C4"}, []string{"C2", "C3", "C4"})
+	var restored []comment
+	require.NoError(rdb.Get(&restored, "C3"))
+	require.Equal("three again", restored[0].Text)
+	require.NoError(rdb.Close())
+
+	corrupt := append([]byte{}, full.Bytes()...)
+	corrupt[len(backupMagic)+10] ^= 0xff
+	opt := restoreOptions()
+	_, err = Restore(bytes.NewReader(corrupt), opt)
+	require.True(errors.Is(err, ErrInvalidBackup))
+	files, _ := ioutil.ReadDir(opt.Dir)
+	require.Empty(files)
+
+	opt = restoreOptions()
+	mkdir(opt.Dir)
+	require.NoError(ioutil.WriteFile(filepath.Join(opt.Dir, "file"), nil, 0644))
+	_, err = Restore(bytes.NewReader(full.Bytes()), opt)
+	require.True(errors.Is(err, ErrDirNotEmpty))
+	_, err = Restore(bytes.NewReader(nil), restoreOptions())
+	require.True(errors.Is(err, ErrInvalidBackup))
+}
+
+func TestExportImport(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB()
+	defer db.Close()
+
+	require.NoError(db.Put(
+		&comment{ID: "C1", Text: "one", Tags: []string{"go"}},
+		&comment{ID: "C2", Text: "two", Tags: []string{"db"}},
+		&comment{ID: "P1", Text: "post"}))
+
+	typeOf := func(id string, doc json.RawMessage) string { return "comment" }
+	var out bytes.Buffer
+	n, err := db.Export(&out, ExportFilter{Prefix: "C", Type: typeOf})
+	require.NoError(err)
+	require.Equal(2, n)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(lines, 2)
+	var first ExportLine
+	require.NoError(json.Unmarshal([]byte(lines[0]), &first))
+	require.Equal("C1", first.ID)
+	require.Equal("comment", first.Type)
+	var c1 []comment
+	require.NoError(db.Get(&c1, "C1"))
+	require.Equal(c1[0].Rev, first.Rev)
+
+	var matched bytes.Buffer
+	n, err = db.Export(&matched, ExportFilter{Match: func(id string, doc json.RawMessage) bool {
+		return strings.Contains(string(doc), "post")
+	}})
+	require.NoError(err)
+	require.Equal(1, n)
+
+	tags := NewView("tags",
+		func(em Emitter, id string, doc interface{}) {
+			switch x := doc.(type) {
+			case *comment:
+				for _, v := range x.Tags {
+					em.Emit([]byte(v), nil)
+				}
+			case json.RawMessage:
+				var c comment
+				if json.Unmarshal(x, &c) == nil {
+					for _, v := range c.Tags {
+						em.Emit([]byte("raw:"+v), nil)
+					}
+				}
+			}
+		})
+	tagged := func(idb *DB, tag string) (ids []string) {
+		l, _, err := idb.Query(Q{View: "tags", Prefix: []byte(tag)})
+		require.NoError(err)
+		for _, r := range l {
+			ids = append(ids, string(r.Key))
+		}
+		return
+	}
+
+	// typed, keeping revs
+	idb := createDB()
+	defer idb.Close()
+	require.NoError(idb.AddView(tags))
+	imported, skipped, err := idb.Import(bytes.NewReader(out.Bytes()), ImportOptions{
+		BatchSize: 1,
+		New: func(typ string) interface{} {
+			if typ == "comment" {
+				return &comment{}
+			}
+			return nil
+		}})
+	require.NoError(err)
+	require.Equal(2, imported)
+	require.Equal(0, skipped)
+	var got []comment
+	require.NoError(idb.Get(&got, "C1"))
+	require.Equal(c1[0], got[0])
+	require.Equal([]string{"C2"}, tagged(idb, "db"))
+	c := &got[0]
+	c.Text = "changed"
+	require.NoError(idb.Put(c))
+	require.True(c.Rev > c1[0].Rev)
+
+	// existing documents are skipped
+	imported, skipped, err = idb.Import(bytes.NewReader(out.Bytes()), ImportOptions{Revs: RevSkipExisting})
+	require.NoError(err)
+	require.Equal(0, imported)
+	require.Equal(2, skipped)
+
+	// the sequence jumps past large revs, at once
+	_, _, err = idb.Import(strings.NewReader(`{"id":"F1","rev":"0000001000000000","doc":{"id":"F1"}}`), ImportOptions{})
+	require.NoError(err)
+	far := &comment{ID: "F2"}
+	require.NoError(idb.Put(far))
+	require.Equal("0000001000000001", far.Rev)
+
+	// untyped, with new revs
+	rdb := createDB()
+	defer rdb.Close()
+	require.NoError(rdb.AddView(tags))
+	imported, _, err = rdb.Import(bytes.NewReader(out.Bytes()), ImportOptions{Revs: RevRegenerate})
+	require.NoError(err)
+	require.Equal(2, imported)
+	got = nil
+	require.NoError(rdb.Get(&got, "C2"))
+	require.Equal("two", got[0].Text)
+	require.NotEqual(first.Rev, got[0].Rev)
+	require.Equal([]string{"C2"}, tagged(rdb, "raw:db"))
+	got[0].Text = "changed"
+	require.NoError(rdb.Put(&got[0]))
+
+	_, _, err = rdb.Import(strings.NewReader(lines[0]+"\n\nnot json\n"), ImportOptions{})
+	require.True(errors.Is(err, ErrInvalidImport))
+	_, _, err = rdb.Import(strings.NewReader(`{"rev":"1","doc":{}}`), ImportOptions{})
+	require.True(errors.Is(err, ErrInvalidImport))
+}
+
+func TestReadOnlyAndDump(t *testing.T) {
+	require := require.New(t)
+
+	opt := restoreOptions()
+	db, err := Open(opt)
+	require.NoError(err)
+	require.NoError(db.Put(&comment{ID: "C1", Text: "one"}, &comment{ID: "C2", Text: "two"}))
+	require.NoError(db.Close())
+
+	opt.ReadOnly = true
+	db, err = Open(opt)
+	require.NoError(err)
+	defer db.Close()
+
+	var res []comment
+	require.NoError(db.Get(&res, "C2"))
+	require.Equal("two", res[0].Text)
+	err = db.Put(&comment{ID: "C3"})
+	require.True(errors.Is(err, ErrReadOnly))
+	for _, revs := range []RevMode{RevKeep, RevRegenerate} {
+		_, _, err = db.Import(strings.NewReader(`{"id":"C3","rev":"00000000000000ff","doc":{}}`), ImportOptions{Revs: revs})
+		require.True(errors.Is(err, ErrReadOnly))
+	}
+	_, err = db.nextRev()
+	require.True(errors.Is(err, ErrReadOnly))
+
+	var ids []string
+	require.NoError(db.Dump([]byte(keysp), func(kv KV) error {
+		ids = append(ids, string(kv.Key))
+		return nil
+	}))
+	require.Equal([]string{"&C1", "&C2"}, ids)
+	stop := errors.New("stop")
+	n := 0
+	err = db.Dump(nil, func(kv KV) error {
+		n++
+		return stop
+	})
+	require.Equal(stop, err)
+	require.Equal(1, n)
+}
+
+func TestDeleteRevAndChanges(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB()
+	defer db.Close()
+
+	var raw RawDoc
+	require.NoError(json.Unmarshal([]byte(`{"id":"R1","n":1}`), &raw))
+	c1 := &comment{ID: "C1"}
+	require.NoError(db.Put(&raw, c1, &comment{ID: "C2"}))
+	require.NotEmpty(raw.Rev)
+	var got RawDoc
+	list, err := db.GetMany([]string{"R1"}, GetOptions{})
+	require.NoError(err)
+	require.NoError(list[0].Unmarshal(&got))
+	require.Equal(raw.Rev, got.Rev)
+	require.Equal("1", string(got.Field("n")))
+	require.Error(json.Unmarshal([]byte(`{"id":1}`), &got))
+
+	changes, err := db.Changes("", 0)
+	require.NoError(err)
+	require.Equal([]Change{{Seq: raw.Rev, ID: "R1"}, {Seq: c1.Rev, ID: "C1"}, {Seq: changes[2].Seq, ID: "C2"}}, changes)
+	changes, err = db.Changes(raw.Rev, 1)
+	require.NoError(err)
+	require.Equal([]Change{{Seq: c1.Rev, ID: "C1"}}, changes)
+
+	err = db.DeleteRev("C1", "bad")
+	require.True(errors.Is(err, ErrNoMatchRev))
+	require.NoError(db.DeleteRev("C1", c1.Rev))
+	require.Equal(ErrNotFound, db.DeleteRev("C1", c1.Rev))
+
+	// a changed document moves to the end, a deleted one too, as deleted
+	require.NoError(db.Put(&raw))
+	changes, err = db.Changes("", 0)
+	require.NoError(err)
+	require.Equal(3, len(changes))
+	require.Equal(Change{Seq: changes[1].Seq, ID: "C1", Deleted: true}, changes[1])
+	require.True(changes[1].Seq > c1.Rev)
+	require.Equal(Change{Seq: raw.Rev, ID: "R1"}, changes[2])
+	require.Equal("C2", changes[0].ID)
+
+	// deleting it again, or a missing document, changes nothing
+	require.NoError(db.Delete("C1", "C9"))
+	again, err := db.Changes("", 0)
+	require.NoError(err)
+	require.Equal(changes, again)
+	s, err := db.Stats()
+	require.NoError(err)
+	require.Equal(2, s.Docs)
+
+	// a document put again is not deleted anymore
+	c1 = &comment{ID: "C1"}
+	require.NoError(db.Put(c1))
+	changes, err = db.Changes(raw.Rev, 0)
+	require.NoError(err)
+	require.Equal([]Change{{Seq: c1.Rev, ID: "C1"}}, changes)
+	changes, err = db.Changes("", 0)
+	require.NoError(err)
+	require.Equal(3, len(changes))
+	s, err = db.Stats()
+	require.NoError(err)
+	require.Equal(3, s.Docs)
+
+	// and by Import
+	require.NoError(db.Delete("C1"))
+	_, _, err = db.Import(strings.NewReader(`{"id":"C1","doc":{"id":"C1"}}`), ImportOptions{})
+	require.NoError(err)
+	changes, err = db.Changes("", 0)
+	require.NoError(err)
+	require.Equal(3, len(changes))
+	require.False(changes[2].Deleted)
+}
+
+func TestStats(t *testing.T) {
+	require := require.New(t)
+
+	opt := restoreOptions()
+	db, err := Open(opt)
+	require.NoError(err)
+
+	tags := NewView("tags",
+		func(em Emitter, id string, doc interface{}) {
+			if c, ok := doc.(*comment); ok {
+				for _, v := range c.Tags {
+					em.Emit([]byte(v), []byte(c.Text))
+				}
+				// duplicates are one entry
+				for _, v := range c.Tags {
+					em.Emit([]byte(v), []byte(c.Text))
+				}
+			}
+		})
+	require.NoError(db.AddView(tags))
+	require.NoError(db.AddView(NewFieldView("by", "by")))
+
+	var docs []interface{}
+	for i := 0; i < 20; i++ {
+		docs = append(docs, &comment{ID: fmt.Sprintf("C%02d", i), By: "dc0d", Text: fmt.Sprint(i), Tags: []string{"a", fmt.Sprint(i % 3)}})
+	}
+	require.NoError(db.Put(docs...))
+	c := docs[0].(*comment)
+	c.Tags = []string{"b"}
+	c.Text = "a longer text"
+	require.NoError(db.Put(c))
+	require.NoError(db.Delete("C01", "C02"))
+	require.NoError(db.RebuildView("by"))
+
+	// the counters match a scan of the views
+	scanned := func() Stats {
+		require.NoError(db.foldCounts())
+		require.NoError(db.db.Update(func(txn *badger.Txn) error {
+			prefix := []byte(pat4Sys(statsBase, ""))
+			return itrFunc(txn, badger.DefaultIteratorOptions, prefix, prefix, func(itr interface{ Item() *badger.Item }) error {
+				return txn.Delete(itr.Item().KeyCopy(nil))
+			})
+		}))
+		require.NoError(initCounts(db.db, sqNS))
+		for _, v := range db.views {
+			require.NoError(initCounts(db.db, v.ns))
+		}
+		s, err := db.Stats()
+		require.NoError(err)
+		return s
+	}
+	s, err := db.Stats()
+	require.NoError(err)
+	require.Equal(18, s.Docs)
+	require.Equal(35, s.Views["tags"].Entries)
+	require.Equal(18, s.Views["by"].Entries)
+	require.True(s.Views["tags"].Size > 0)
+	changes, err := db.Changes("", 0)
+	require.NoError(err)
+	require.Equal(changes[len(changes)-1].Seq, s.Seq)
+	require.True(s.Seq > c.Rev)
+	require.True(s.LastGC.IsZero())
+	require.Equal(s.Views, scanned().Views)
+
+	require.NoError(db.DeleteView("by"))
+	s, err = db.Stats()
+	require.NoError(err)
+	require.Equal(ViewStats{}, s.Views["by"])
+	require.Equal(18, s.Docs)
+
+	// counters are kept across opens
+	require.NoError(db.Close())
+	db, err = Open(opt)
+	require.NoError(err)
+	defer db.Close()
+	require.NoError(db.AddView(tags))
+	require.NoError(db.Delete("C03"))
+	s, err = db.Stats()
+	require.NoError(err)
+	require.Equal(17, s.Docs)
+	require.Equal(33, s.Views["tags"].Entries)
+	require.Equal(s.Views["tags"], scanned().Views["tags"])
+}
+
+func TestMetrics(t *testing.T) {
+	require := require.New(t)
+
+	m := NewMetrics()
+	opt := restoreOptions()
+	opt.Observer = m
+	db, err := Open(opt)
+	require.NoError(err)
+	defer db.Close()
+
+	require.NoError(db.AddView(NewFieldView("by", "by")))
+	c := &comment{ID: "C1", By: "dc0d", Text: "hi"}
+	require.NoError(db.Put(c))
+	rev := c.Rev
+	require.NoError(db.Put(c))
+	c.Rev = rev
+	require.True(errors.Is(db.Put(c), ErrNoMatchRev))
+	var got []comment
+	require.NoError(db.Get(&got, "C1"))
+	_, _, err = db.Query(Q{View: "by", Start: []byte("dc0d")})
+	require.NoError(err)
+	db.runGC()
+	m.TxnSplit("import")
+
+	require.Equal(uint64(3), m.ops["put"].count)
+	require.Equal(uint64(1), m.opErrors["put"])
+	require.Equal(uint64(1), m.conflicts["put"])
+	require.Equal(uint64(1), m.ops["get"].count)
+	require.Equal(uint64(1), m.ops["query"].count)
+	require.Equal(uint64(2), m.views["by"].count)
+	require.True(m.txns["put"].count >= 3)
+	require.Equal(uint64(1), m.gc.count)
+
+	var buf bytes.Buffer
+	require.NoError(m.WritePrometheus(&buf))
+	text := buf.String()
+	require.Contains(text, "# TYPE dockage_op_duration_seconds histogram\n")
+	require.Contains(text, `dockage_op_duration_seconds_bucket{op="put",le="+Inf"} 3`+"\n")
+	require.Contains(text, `dockage_op_duration_seconds_count{op="get"} 1`+"\n")
+	require.Contains(text, `dockage_rev_conflicts_total{op="put"} 1`+"\n")
+	require.Contains(text, `dockage_view_build_duration_seconds_count{view="by"} 2`+"\n")
+	require.Contains(text, "dockage_gc_duration_seconds_count 1\n")
+	require.Contains(text, `dockage_txn_splits_total{op="import"} 1`+"\n")
+
+	m.Publish("dockage_test_metrics")
+	var snap struct {
+		Ops       map[string]struct{ Count uint64 }
+		Conflicts map[string]uint64
+	}
+	require.NoError(json.Unmarshal([]byte(expvar.Get("dockage_test_metrics").String()), &snap))
+	require.Equal(uint64(3), snap.Ops["put"].Count)
+	require.Equal(uint64(1), snap.Conflicts["put"])
+}
+
+func TestOpenOptions(t *testing.T) {
+	require := require.New(t)
+
+	for _, bad := range []func(*Options){
+		func(o *Options) { o.Dir = "" },
+		func(o *Options) { o.ValueDir = "" },
+		func(o *Options) { o.TableLoadingMode = LoadMemoryMap + 1 },
+		func(o *Options) { o.ValueLogLoadingMode = -1 },
+		func(o *Options) { o.ValueThreshold = MaxValueThreshold + 1 },
+		func(o *Options) { o.MaxTableSize = -1 },
+		func(o *Options) { o.NumMemtables = -1 },
+		func(o *Options) { o.Truncate, o.ReadOnly = true, true },
+		func(o *Options) { o.GCDiscardRatio = 1 },
+		func(o *Options) { o.GCMaxRuns = -1 },
+	} {
+		opt := restoreOptions()
+		bad(&opt)
+		_, err := Open(opt)
+		require.True(errors.Is(err, ErrInvalidOptions), "%v", err)
+	}
+
+	opt := restoreOptions()
+	opt.NoSyncWrites = true
+	opt.TableLoadingMode = LoadFileIO
+	opt.ValueLogLoadingMode = LoadFileIO
+	opt.ValueThreshold = 64
+	opt.MaxTableSize = 8 << 20
+	opt.NumMemtables = 2
+	opt.Truncate = true
+	var tuned badger.Options
+	opt.Badger = func(bopt *badger.Options) {
+		bopt.NumCompactors = 2
+		tuned = *bopt
+	}
+	db, err := Open(opt)
+	require.NoError(err)
+	defer db.Close()
+	require.False(tuned.SyncWrites)
+	require.True(tuned.Truncate)
+	require.Equal(options.FileIO, tuned.TableLoadingMode)
+	require.Equal(options.FileIO, tuned.ValueLogLoadingMode)
+	require.Equal(64, tuned.ValueThreshold)
+	require.Equal(int64(8<<20), tuned.MaxTableSize)
+	require.Equal(2, tuned.NumMemtables)
+	require.Equal(2, tuned.NumCompactors)
+
+	c := &comment{ID: "C1", Text: strings.Repeat("x", 100)}
+	require.NoError(db.Put(c))
+	var got []comment
+	require.NoError(db.Get(&got, "C1"))
+	require.Equal(c.Text, got[0].Text)
+}
+
+func TestOpenOptionsDefaults(t *testing.T) {
+	require := require.New(t)
+
+	opt := restoreOptions()
+	var tuned badger.Options
+	opt.Badger = func(bopt *badger.Options) { tuned = *bopt }
+	db, err := Open(opt)
+	require.NoError(err)
+	defer db.Close()
+	require.True(tuned.SyncWrites)
+	require.False(tuned.Truncate)
+}
+
+func TestInMemory(t *testing.T) {
+	require := require.New(t)
+
+	for _, opt := range []Options{
+		{InMemory: true, Dir: "x"},
+		{InMemory: true, ValueDir: "x"},
+		{InMemory: true, ReadOnly: true},
+	} {
+		_, err := Open(opt)
+		require.True(errors.Is(err, ErrInvalidOptions), "%v", err)
+	}
+
+	mem, err := Open(Options{InMemory: true})
+	require.NoError(err)
+	dir := mem.tmpDir
+	require.NotEmpty(dir)
+	require.NoError(mem.AddView(NewFieldView("by", "by")))
+	require.NoError(mem.Put(&comment{ID: "C1", By: "dc0d"}))
+	res, _, err := mem.Query(Q{View: "by", Prefix: keys.MustEncode("dc0d")})
+	require.NoError(err)
+	require.Len(res, 1)
+
+	// restore into memory
+	var buf bytes.Buffer
+	_, err = mem.Backup(&buf, 0)
+	require.NoError(err)
+	restored, err := Restore(&buf, Options{InMemory: true})
+	require.NoError(err)
+	var got []comment
+	require.NoError(restored.Get(&got, "C1"))
+	require.Equal("dc0d", got[0].By)
+	require.NotEqual(dir, restored.tmpDir)
+	require.NoError(restored.Close())
+	_, err = os.Stat(restored.tmpDir)
+	require.True(os.IsNotExist(err))
+
+	require.NoError(mem.Close())
+	_, err = os.Stat(dir)
+	require.True(os.IsNotExist(err))
+}
+
+func TestFoldCountsInBackground(t *testing.T) {
+	require := require.New(t)
+
+	db, err := Open(Options{InMemory: true, GCInterval: -1})
+	require.NoError(err)
+	defer db.Close()
+
+	deltas := func() (n int) {
+		require.NoError(db.db.View(func(txn *badger.Txn) error {
+			prefix := []byte(pat4Sys(statsDelta, ""))
+			opt := badger.DefaultIteratorOptions
+			opt.PrefetchValues = false
+			return itrFunc(txn, opt, prefix, prefix, func(itr interface{ Item() *badger.Item }) error {
+				n++
+				return nil
+			})
+		}))
+		return
+	}
+	for i := 0; i < foldAfter; i++ {
+		require.NoError(db.Put(&comment{ID: fmt.Sprint(i)}))
+	}
+	db.foldDone.Wait()
+	require.True(deltas() < foldAfter/2, "%d", deltas())
+	s, err := db.Stats()
+	require.NoError(err)
+	require.Equal(foldAfter, s.Docs)
+}
+
+func TestGC(t *testing.T) {
+	require := require.New(t)
+
+	m := NewMetrics()
+	db, err := Open(Options{InMemory: true, GCInterval: 10 * time.Millisecond, Observer: m})
+	require.NoError(err)
+
+	var docs []interface{}
+	for i := 0; i < 100; i++ {
+		docs = append(docs, &comment{ID: fmt.Sprint(i), Text: strings.Repeat("x", 1000)})
+	}
+	require.NoError(db.Put(docs...))
+	require.NoError(db.Delete("1", "2", "3"))
+
+	gcRuns := func() uint64 {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return m.gc.count
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for gcRuns() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.NotZero(gcRuns())
+
+	// Compact waits for the runs of the loop
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(db.Compact())
+		}()
+	}
+	wg.Wait()
+
+	// the loop is stopped by Close
+	require.NoError(db.Close())
+	runs := gcRuns()
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(runs, gcRuns())
+
+	// never, with a negative interval
+	db, err = Open(Options{InMemory: true, GCInterval: -1})
+	require.NoError(err)
+	require.Nil(db.gcStop)
+
+	// a run with nothing to rewrite is not the last gc
+	require.Equal(badger.ErrNoRewrite, db.runGC())
+	s, err := db.Stats()
+	require.NoError(err)
+	require.True(s.LastGC.IsZero())
+	require.NoError(db.Close())
+}
+
+func TestContext(t *testing.T) {
+	require := require.New(t)
+
+	db, err := Open(Options{InMemory: true})
+	require.NoError(err)
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelAt := ""
+	require.NoError(db.AddView(NewView("by",
+		func(em Emitter, id string, doc interface{}) {
+			if id == cancelAt {
+				cancel()
+			}
+			if c, ok := doc.(*comment); ok {
+				em.Emit([]byte(c.By), nil)
+			}
+		})))
+	require.NoError(db.PutContext(ctx, &comment{ID: "C1", By: "dc0d"}, &comment{ID: "C2", By: "dc0d"}))
+
+	// canceled while views are built, nothing is written
+	cancelAt = "C4"
+	err = db.PutContext(ctx, &comment{ID: "C3", By: "dc0d"}, &comment{ID: "C4", By: "dc0d"})
+	require.Equal(context.Canceled, err)
+	var got []comment
+	require.True(errors.Is(db.Get(&got, "C3"), ErrNotFound))
+
+	_, _, err = db.QueryContext(ctx, Q{View: "by", Prefix: []byte("dc0d")})
+	require.Equal(context.Canceled, err)
+	require.Equal(context.Canceled, db.GetContext(ctx, &got, "C1"))
+	_, err = db.GetManyContext(ctx, []string{"C1"}, GetOptions{})
+	require.Equal(context.Canceled, err)
+	require.Equal(context.Canceled, db.DeleteContext(ctx, "C1"))
+	require.Equal(context.Canceled, db.DeleteViewContext(ctx, "by"))
+
+	// the view is left as it was
+	res, _, err := db.Query(Q{View: "by", Prefix: []byte("dc0d")})
+	require.NoError(err)
+	require.Len(res, 2)
+
+	require.NoError(db.Get(&got, "C1"))
+	ctx, cancel = context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	require.Equal(context.DeadlineExceeded, db.DeleteRevContext(ctx, "C1", got[0].Rev))
+	got = nil
+	require.NoError(db.GetContext(context.Background(), &got, "C1", "C2"))
+	require.Len(got, 2)
 }
@@ -0,0 +1,40 @@
+// Package dockagetest provides in-memory databases for tests.
+package dockagetest
+
+import (
+	"testing"
+
+	"github.com/dc0d/dockage"
+)
+
+//-----------------------------------------------------------------------------
+
+// New returns a new, empty in-memory database with views added, that is
+// closed when the test and its subtests are complete.
+func New(t testing.TB, views ...dockage.View) *dockage.DB {
+	return Open(t, dockage.Options{}, views...)
+}
+
+// Open is like New, with options; opt.InMemory is set, and opt.Dir and
+// opt.ValueDir must be empty.
+func Open(t testing.TB, opt dockage.Options, views ...dockage.View) *dockage.DB {
+	t.Helper()
+	opt.InMemory = true
+	db, err := dockage.Open(opt)
+	if err != nil {
+		t.Fatalf("dockagetest: open: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("dockagetest: close: %v", err)
+		}
+	})
+	for _, v := range views {
+		if err := db.AddView(v); err != nil {
+			t.Fatalf("dockagetest: add view: %v", err)
+		}
+	}
+	return db
+}
+
+//-----------------------------------------------------------------------------
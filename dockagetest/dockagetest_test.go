@@ -0,0 +1,33 @@
+package dockagetest
+
+import (
+	"testing"
+
+	"github.com/dc0d/dockage"
+	"github.com/dc0d/dockage/keys"
+	"github.com/stretchr/testify/require"
+)
+
+type post struct {
+	ID  string `json:"id"`
+	Rev string `json:"rev"`
+	By  string `json:"by"`
+}
+
+func TestNew(t *testing.T) {
+	require := require.New(t)
+
+	db := New(t, dockage.NewFieldView("by", "by"))
+	require.NoError(db.Put(&post{ID: "P1", By: "dc0d"}, &post{ID: "P2", By: "dc0d"}))
+	res, _, err := db.Query(dockage.Q{View: "by", Prefix: keys.MustEncode("dc0d")})
+	require.NoError(err)
+	require.Len(res, 2)
+
+	// each database is new
+	other := Open(t, dockage.Options{IDGenerator: dockage.NewSequenceIDGenerator("P")})
+	var got []post
+	require.Error(other.Get(&got, "P1"))
+	p := &post{By: "dc0d"}
+	require.NoError(other.Put(p))
+	require.NotEmpty(p.ID)
+}
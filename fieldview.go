@@ -0,0 +1,137 @@
+package dockage
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/dc0d/dockage/keys"
+)
+
+//-----------------------------------------------------------------------------
+
+// NewFieldView creates a View that indexes documents by the values found at
+// json paths, like "by" or "author.name", inside the stored json document.
+// No Go types are involved, so field views can be defined from configuration
+// and rebuilt from stored documents, using RebuildView(...).
+//
+// With more than one path, the view key is the tuple of the values, in the
+// order of paths. A path that points to an array indexes each element of that
+// array. Documents that lack any of the paths are not indexed. The keys are
+// encoded by package keys, to preserve the order of json values; use it to
+// build query parameters and to decode Res.Index.
+func NewFieldView(name string, paths ...string) (resview View) {
+	if len(paths) == 0 {
+		panic("paths must be provided")
+	}
+	var splitted [][]string
+	for _, p := range paths {
+		if p == "" {
+			panic("paths must not be empty")
+		}
+		splitted = append(splitted, strings.Split(p, "."))
+	}
+	viewFn := func(emitter Emitter, id string, doc interface{}) (inf interface{}, err error) {
+		js, ok := doc.(json.RawMessage)
+		if !ok {
+			if js, err = json.Marshal(doc); err != nil {
+				return
+			}
+		}
+		dec := json.NewDecoder(bytes.NewReader(js))
+		dec.UseNumber()
+		var parsed interface{}
+		if err = dec.Decode(&parsed); err != nil {
+			return
+		}
+		var found [][]interface{}
+		for _, p := range splitted {
+			vals := lookup(parsed, p)
+			if len(vals) == 0 {
+				return
+			}
+			found = append(found, vals)
+		}
+		emitted, err := fieldKeys(found)
+		if err != nil {
+			return
+		}
+		for _, k := range emitted {
+			emitter.Emit(k, nil)
+		}
+		return
+	}
+	resview = newView(name, viewFn)
+	resview.jsonDoc = true
+	resview.paths = paths
+	return
+}
+
+// lookup returns the values at path inside v. Arrays on the way are either
+// indexed by a numeric segment, or searched element by element; an array at
+// the end of path gives its elements.
+func lookup(v interface{}, path []string) []interface{} {
+	return flatten(lookupWhole(v, path))
+}
+
+// lookupWhole is like lookup, but an array at the end of path is one value.
+func lookupWhole(v interface{}, path []string) (resvals []interface{}) {
+	if len(path) == 0 {
+		return []interface{}{v}
+	}
+	switch x := v.(type) {
+	case map[string]interface{}:
+		child, ok := x[path[0]]
+		if !ok {
+			return nil
+		}
+		return lookupWhole(child, path[1:])
+	case []interface{}:
+		if ix, err := strconv.Atoi(path[0]); err == nil {
+			if ix < 0 || ix >= len(x) {
+				return nil
+			}
+			return lookupWhole(x[ix], path[1:])
+		}
+		for _, elem := range x {
+			resvals = append(resvals, lookupWhole(elem, path)...)
+		}
+	}
+	return
+}
+
+// flatten replaces arrays in vals by their elements.
+func flatten(vals []interface{}) (resvals []interface{}) {
+	for _, v := range vals {
+		if arr, ok := v.([]interface{}); ok {
+			resvals = append(resvals, arr...)
+			continue
+		}
+		resvals = append(resvals, v)
+	}
+	return
+}
+
+// fieldKeys encodes all combinations of found values, one list of values
+// per path.
+func fieldKeys(found [][]interface{}) (reskeys [][]byte, reserr error) {
+	reskeys = [][]byte{nil}
+	for _, vals := range found {
+		var next [][]byte
+		for _, prefix := range reskeys {
+			for _, v := range vals {
+				k, err := keys.Append(append([]byte{}, prefix...), v)
+				if err != nil {
+					reserr = err
+					return
+				}
+				next = append(next, k)
+			}
+		}
+		reskeys = next
+	}
+	return
+}
+
+//-----------------------------------------------------------------------------
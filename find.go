@@ -0,0 +1,489 @@
+package dockage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dc0d/dockage/keys"
+	"github.com/dgraph-io/badger"
+)
+
+//-----------------------------------------------------------------------------
+
+// FindOptions are options for Find(...).
+type FindOptions struct {
+	Skip  int
+	Limit int // default 100
+}
+
+// Plan describes how Find(...) runs a selector.
+type Plan struct {
+	// View is the field view that is scanned; it is empty for a full scan
+	// of documents.
+	View string
+	// Field is the selector field that is looked up in View.
+	Field string
+	// Op is the operation on Field: $eq, $in or $range.
+	Op string
+}
+
+// FullScan is true when no view could be used.
+func (p Plan) FullScan() bool { return p.View == "" }
+
+func (p Plan) String() string {
+	if p.FullScan() {
+		return "full scan of documents"
+	}
+	return fmt.Sprintf("view %s: %s %s", p.View, p.Field, p.Op)
+}
+
+// Find returns documents matching a Mango style selector, sorted by id. Key
+// of results is the document id and Val is its json. The selector is either
+// json ([]byte, json.RawMessage or string) or a value that marshals to json:
+//
+//	{"by": "Frodo", "at": {"$gte": "2018-05-20"}, "tags": {"$in": ["golang"]}}
+//
+// Fields are json paths like "author.name". A field is compared to a value,
+// or to an object of operators: $eq, $ne, $gt, $gte, $lt, $lte, $in, $nin and
+// $exists. An array field matches if any of its elements matches. $and and
+// $or take a list of selectors. Values are ordered like package keys orders
+// them, and only values of the same kind are compared by $gt, $gte, $lt, $lte.
+//
+// If a field view on a field of the selector is added, only the documents
+// found by that view are checked; otherwise all documents are scanned. Use
+// Explain(...) to see which one is chosen.
+func (db *DB) Find(selector interface{}, opt FindOptions) (reslist []Res, reserr error) {
+	sel, err := parseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	plan, q := db.plan(sel)
+	if opt.Limit <= 0 {
+		opt.Limit = 100
+	}
+	skip := opt.Skip
+	reserr = db.view("find", func(txn *badger.Txn) error {
+		check := func(id string, js []byte) (bool, error) {
+			ok, err := sel.matchJSON(js)
+			if err != nil || !ok {
+				return false, err
+			}
+			if skip > 0 {
+				skip--
+				return false, nil
+			}
+			reslist = append(reslist, Res{KV: KV{Key: []byte(id), Val: js}})
+			return len(reslist) >= opt.Limit, nil
+		}
+
+		if plan.FullScan() {
+			prefix := []byte(keysp)
+			return itrFunc(txn, badger.DefaultIteratorOptions, prefix, prefix, func(itr interface{ Item() *badger.Item }) error {
+				item := itr.Item()
+				js, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				done, err := check(string(bytes.TrimPrefix(item.Key(), prefix)), js)
+				if err == nil && done {
+					return errStop
+				}
+				return err
+			})
+		}
+
+		ids, err := q.eval(db, txn)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			js, err := getDoc(txn, id)
+			if err != nil {
+				return err
+			}
+			done, err := check(id, js)
+			if err != nil {
+				return err
+			}
+			if done {
+				return nil
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// Explain returns the plan that Find(...) uses for selector.
+func (db *DB) Explain(selector interface{}) (resplan Plan, reserr error) {
+	sel, err := parseSelector(selector)
+	if err != nil {
+		return Plan{}, err
+	}
+	resplan, _ = db.plan(sel)
+	return
+}
+
+//-----------------------------------------------------------------------------
+
+// plan picks the field view, whose first path is a field of the selector,
+// with the most selective predicate: $eq, then $in, then a range with two
+// bounds and then a range with one bound.
+//
+// A field view with more paths skips documents that lack a value at any of
+// them, so it is only used if the selector needs a value at each of its
+// other paths too.
+func (db *DB) plan(sel *selector) (resplan Plan, resq Q) {
+	best := 0
+	for _, v := range db.views {
+		if len(v.paths) == 0 || !sel.needsValues(v.paths[1:]) {
+			continue
+		}
+		rank, op, ranges := sel.indexRanges(v.paths[0])
+		if rank == 0 || (best != 0 && rank >= best) {
+			continue
+		}
+		best = rank
+		resplan = Plan{View: v.name, Field: v.paths[0], Op: op}
+		resq = Q{View: v.name, Ranges: ranges}
+	}
+	return
+}
+
+// needsValues reports if documents matching the selector have at least one
+// value at each of fields, by a top level predicate. $exists is not enough,
+// an empty array exists but has no values.
+func (sel *selector) needsValues(fields []string) bool {
+	for _, field := range fields {
+		var needed bool
+		for _, p := range sel.preds {
+			if p.field != field {
+				continue
+			}
+			switch p.op {
+			case "$eq", "$gt", "$gte", "$lt", "$lte":
+				_, isArray := p.arg.([]interface{})
+				needed = !isArray
+			case "$in":
+				needed = len(p.arg.([]interface{})) > 0
+				for _, a := range p.arg.([]interface{}) {
+					if _, isArray := a.([]interface{}); isArray {
+						needed = false
+					}
+				}
+			}
+			if needed {
+				break
+			}
+		}
+		if !needed {
+			return false
+		}
+	}
+	return true
+}
+
+// indexRanges returns the ranges of a field view on field, that contain all
+// documents matching the selector. Only top level predicates are used.
+func (sel *selector) indexRanges(field string) (resrank int, resop string, resranges []Range) {
+	var lo, hi []byte
+	for _, p := range sel.preds {
+		if p.field != field {
+			continue
+		}
+		switch p.op {
+		case "$eq":
+			if k, ok := indexKey(p.arg); ok {
+				return 1, "$eq", []Range{{Prefix: k}}
+			}
+		case "$in":
+			if resrank == 2 {
+				continue
+			}
+			var ranges []Range
+			for _, v := range p.arg.([]interface{}) {
+				k, ok := indexKey(v)
+				if !ok {
+					ranges = nil
+					break
+				}
+				ranges = append(ranges, Range{Prefix: k})
+			}
+			if ranges != nil {
+				resrank, resop, resranges = 2, "$in", ranges
+			}
+		case "$gt", "$gte":
+			if k, ok := indexKey(p.arg); ok && lo == nil {
+				lo = k
+			}
+		case "$lt", "$lte":
+			if k, ok := indexKey(p.arg); ok && hi == nil {
+				hi = k
+			}
+		}
+	}
+	if resrank != 0 || (lo == nil && hi == nil) {
+		return
+	}
+	// ranges contain all keys of the same kind, starting with a bound;
+	// the bounds themselves are checked in memory.
+	r := Range{Start: lo, End: append(hi, 0xff)}
+	resrank = 3
+	if lo == nil {
+		r.Start = []byte{kindOf(hi)}
+		resrank = 4
+	}
+	if hi == nil {
+		r.End = []byte{kindOf(lo) + 0x10}
+		resrank = 4
+	}
+	return resrank, "$range", []Range{r}
+}
+
+// indexKey is the encoded form of a scalar value, as emitted by field views.
+func indexKey(v interface{}) ([]byte, bool) {
+	switch v.(type) {
+	case []interface{}, map[string]interface{}:
+		return nil, false
+	}
+	k, err := keys.Encode(v)
+	if err != nil {
+		return nil, false
+	}
+	return k, true
+}
+
+// kindOf returns the kind of an encoded value; true and false are of
+// the same kind.
+func kindOf(k []byte) byte {
+	if len(k) == 0 {
+		return 0
+	}
+	return k[0] &^ 0x0f
+}
+
+//-----------------------------------------------------------------------------
+
+type predicate struct {
+	field string
+	path  []string
+	op    string
+	arg   interface{}
+}
+
+type selector struct {
+	preds []predicate
+	ors   [][]*selector
+}
+
+func parseSelector(from interface{}) (*selector, error) {
+	var js []byte
+	switch x := from.(type) {
+	case []byte:
+		js = x
+	case json.RawMessage:
+		js = x
+	case string:
+		js = []byte(x)
+	default:
+		var err error
+		if js, err = json.Marshal(from); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidSelector, err)
+		}
+	}
+	var parsed interface{}
+	if err := decodeJSON(js, &parsed); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSelector, err)
+	}
+	sel := new(selector)
+	if err := sel.parse(parsed); err != nil {
+		return nil, err
+	}
+	return sel, nil
+}
+
+func (sel *selector) parse(v interface{}) error {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%w: selector must be an object", ErrInvalidSelector)
+	}
+	fields := make([]string, 0, len(m))
+	for f := range m {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	for _, f := range fields {
+		arg := m[f]
+		switch f {
+		case "$and", "$or":
+			list, ok := arg.([]interface{})
+			if !ok {
+				return fmt.Errorf("%w: %s needs a list", ErrInvalidSelector, f)
+			}
+			var subs []*selector
+			for _, item := range list {
+				sub := new(selector)
+				if err := sub.parse(item); err != nil {
+					return err
+				}
+				subs = append(subs, sub)
+			}
+			if f == "$or" {
+				sel.ors = append(sel.ors, subs)
+				continue
+			}
+			for _, sub := range subs {
+				sel.preds = append(sel.preds, sub.preds...)
+				sel.ors = append(sel.ors, sub.ors...)
+			}
+			continue
+		}
+		if strings.HasPrefix(f, "$") {
+			return fmt.Errorf("%w: unknown operator %s", ErrInvalidSelector, f)
+		}
+		path := strings.Split(f, ".")
+		ops, ok := arg.(map[string]interface{})
+		if !ok || !isOperators(ops) {
+			sel.preds = append(sel.preds, predicate{field: f, path: path, op: "$eq", arg: arg})
+			continue
+		}
+		names := make([]string, 0, len(ops))
+		for op := range ops {
+			names = append(names, op)
+		}
+		sort.Strings(names)
+		for _, op := range names {
+			p := predicate{field: f, path: path, op: op, arg: ops[op]}
+			switch op {
+			case "$eq", "$ne", "$gt", "$gte", "$lt", "$lte":
+			case "$in", "$nin":
+				if _, ok := p.arg.([]interface{}); !ok {
+					return fmt.Errorf("%w: %s of %s needs a list", ErrInvalidSelector, op, f)
+				}
+			case "$exists":
+				if _, ok := p.arg.(bool); !ok {
+					return fmt.Errorf("%w: $exists of %s needs a bool", ErrInvalidSelector, f)
+				}
+			default:
+				return fmt.Errorf("%w: unknown operator %s", ErrInvalidSelector, op)
+			}
+			sel.preds = append(sel.preds, p)
+		}
+	}
+	return nil
+}
+
+// isOperators reports if all keys of m are operators.
+func isOperators(m map[string]interface{}) bool {
+	if len(m) == 0 {
+		return false
+	}
+	for k := range m {
+		if !strings.HasPrefix(k, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+func decodeJSON(js []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+//-----------------------------------------------------------------------------
+
+func (sel *selector) matchJSON(js []byte) (bool, error) {
+	var doc interface{}
+	if err := decodeJSON(js, &doc); err != nil {
+		return false, err
+	}
+	return sel.match(doc), nil
+}
+
+func (sel *selector) match(doc interface{}) bool {
+	for _, p := range sel.preds {
+		if !p.match(doc) {
+			return false
+		}
+	}
+	for _, subs := range sel.ors {
+		var found bool
+		for _, sub := range subs {
+			if sub.match(doc) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (p predicate) match(doc interface{}) bool {
+	whole := lookupWhole(doc, p.path)
+	vals := flatten(whole)
+	switch p.op {
+	case "$exists":
+		return (len(whole) > 0) == p.arg.(bool)
+	case "$eq":
+		return anyEqual(vals, p.arg) || anyEqual(whole, p.arg)
+	case "$ne":
+		return !anyEqual(vals, p.arg) && !anyEqual(whole, p.arg)
+	case "$in":
+		for _, a := range p.arg.([]interface{}) {
+			if anyEqual(vals, a) || anyEqual(whole, a) {
+				return true
+			}
+		}
+		return false
+	case "$nin":
+		for _, a := range p.arg.([]interface{}) {
+			if anyEqual(vals, a) || anyEqual(whole, a) {
+				return false
+			}
+		}
+		return true
+	}
+	ak, err := keys.Encode(p.arg)
+	if err != nil {
+		return false
+	}
+	for _, v := range vals {
+		vk, err := keys.Encode(v)
+		if err != nil || kindOf(vk) != kindOf(ak) {
+			continue
+		}
+		c := bytes.Compare(vk, ak)
+		switch {
+		case p.op == "$gt" && c > 0,
+			p.op == "$gte" && c >= 0,
+			p.op == "$lt" && c < 0,
+			p.op == "$lte" && c <= 0:
+			return true
+		}
+	}
+	return false
+}
+
+func anyEqual(vals []interface{}, arg interface{}) bool {
+	ak, err := keys.Encode(arg)
+	if err != nil {
+		return false
+	}
+	for _, v := range vals {
+		vk, err := keys.Encode(v)
+		if err == nil && bytes.Equal(vk, ak) {
+			return true
+		}
+	}
+	return false
+}
+
+//-----------------------------------------------------------------------------
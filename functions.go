@@ -1,26 +1,32 @@
 package dockage
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"hash/fnv"
+	"reflect"
 	"strings"
 
 	"github.com/dgraph-io/badger"
 	"github.com/fatih/structs"
 )
 
-func prepdoc(doc interface{}) (resID []byte, resRev *structs.Field, reserr error) {
+func prepdoc(doc interface{}, gen IDGenerator) (resID []byte, resRev *structs.Field, reserr error) {
 	ins := new(inspector)
-	ins.inspect(doc)
-	if ins.id == "" {
-		reserr = ErrNoID
+	if reserr = ins.inspect(doc); reserr != nil {
 		return
 	}
-	sid := ins.id
-	if strings.ContainsAny(sid, specials) {
-		reserr = ErrInvalidID
+	if ins.id == "" && ins.fid != nil && gen != nil {
+		if reserr = ins.generateID(doc, gen); reserr != nil {
+			return
+		}
+	}
+	if ins.id == "" {
+		reserr = ErrNoID
 		return
 	}
-	resID = []byte(sid)
+	resID = []byte(ins.id)
 	if ins.rev == nil {
 		reserr = ErrNoRev
 		return
@@ -29,6 +35,8 @@ func prepdoc(doc interface{}) (resID []byte, resRev *structs.Field, reserr error
 	return
 }
 
+const fnvsize = 8
+
 func fnvhash(v []byte) []byte {
 	h := fnv.New64a()
 	h.Write(v)
@@ -47,6 +55,78 @@ func pat4Sys(s ...string) string {
 	return syssp + strings.Join(s, syssp)
 }
 
+// View keys are made of the view namespace, the domain and two segments. The
+// first segment is escaped and terminated, so any bytes can be used in ids
+// and emitted view keys, while keeping their order and allowing prefix
+// queries. The last segment is taken as is:
+//
+//	^NS[ VIEW-KEY 0x00 0x01 ID   (x2k: view key to id)
+//	^NS] ID 0x00 0x01 VIEW-KEY   (k2x: id to view key)
+//
+// Inside a segment 0x00 is escaped as 0x00 0xff.
+const (
+	segesc  = 0xff
+	segterm = 0x01
+)
+
+// appendEscaped appends the escaped form of seg to dst, without terminating
+// it; it is used for query boundaries.
+func appendEscaped(dst, seg []byte) []byte {
+	for _, b := range seg {
+		if b == 0x00 {
+			dst = append(dst, 0x00, segesc)
+			continue
+		}
+		dst = append(dst, b)
+	}
+	return dst
+}
+
+// appendSegment appends the escaped and terminated form of seg to dst.
+func appendSegment(dst, seg []byte) []byte {
+	return append(appendEscaped(dst, seg), 0x00, segterm)
+}
+
+// readSegment reads an escaped and terminated segment from the start of b.
+func readSegment(b []byte) (seg, rest []byte, ok bool) {
+	seg = []byte{}
+	for i := 0; i < len(b); i++ {
+		if b[i] != 0x00 {
+			seg = append(seg, b[i])
+			continue
+		}
+		if i+1 >= len(b) {
+			return nil, nil, false
+		}
+		switch b[i+1] {
+		case segterm:
+			return seg, b[i+2:], true
+		case segesc:
+			seg = append(seg, 0x00)
+			i++
+		default:
+			return nil, nil, false
+		}
+	}
+	return nil, nil, false
+}
+
+// viewHeader is the length of the part of a view key before its segments.
+const viewHeader = len(viewsp) + nssize + len(viewx2k)
+
+// splitViewKey splits a view key into its two segments, after the view
+// namespace and the domain.
+func splitViewKey(k []byte) (first, second []byte) {
+	if len(k) < viewHeader {
+		return nil, nil
+	}
+	first, second, ok := readSegment(k[viewHeader:])
+	if !ok {
+		return nil, nil
+	}
+	return
+}
+
 func getlimits(params Q) (skip, limit int, applySkip, applyLimit bool) {
 	skip = params.Skip
 	limit = params.Limit
@@ -63,7 +143,10 @@ func getlimits(params Q) (skip, limit int, applySkip, applyLimit bool) {
 	return
 }
 
-func stopWords(params Q, forIndexedKeys ...bool) (start, end, prefix []byte) {
+func stopWords(params Q, ns string) (start, end, prefix []byte) {
+	if len(params.Start) == 0 {
+		params.Start = params.Prefix
+	}
 	if params.View == "" {
 		start = []byte(pat4Key(string(params.Start)))
 		if len(params.End) > 0 {
@@ -75,61 +158,210 @@ func stopWords(params Q, forIndexedKeys ...bool) (start, end, prefix []byte) {
 			prefix = start
 		}
 	} else {
-		name := string(fnvhash([]byte(params.View)))
-		domain := viewx2k
-		if len(forIndexedKeys) > 0 && forIndexedKeys[0] {
-			domain = viewk2x
-		}
-		pfx := pat4View(name + domain)
-		start = []byte(pfx + pat4View(string(params.Start)))
+		pfx := []byte(pat4View(ns + viewx2k))
+		start = appendEscaped(pfx[:len(pfx):len(pfx)], params.Start)
 		if len(params.End) > 0 {
-			end = []byte(pfx + pat4View(string(params.End)))
+			end = appendEscaped(pfx[:len(pfx):len(pfx)], params.End)
 		}
 		if len(params.Prefix) > 0 {
-			prefix = []byte(pfx + pat4View(string(params.Prefix)))
+			prefix = appendEscaped(pfx[:len(pfx):len(pfx)], params.Prefix)
 		} else {
-			prefix = []byte(pfx)
+			prefix = pfx
 		}
 	}
 	return
 }
 
+// scan is one key range of a query.
+type scan struct {
+	start, end, prefix []byte
+	group              int
+	// exact scans read only the key start.
+	exact bool
+}
+
+func scans(params Q, ns string) (resscans []scan) {
+	if len(params.Keys) == 0 && len(params.Ranges) == 0 {
+		start, end, prefix := stopWords(params, ns)
+		return []scan{{start: start, end: end, prefix: prefix}}
+	}
+	for i, k := range params.Keys {
+		if params.View == "" {
+			resscans = append(resscans, scan{start: []byte(pat4Key(string(k))), group: i, exact: true})
+			continue
+		}
+		pfx := appendSegment([]byte(pat4View(ns+viewx2k)), k)
+		resscans = append(resscans, scan{start: pfx, prefix: pfx, group: i})
+	}
+	for i, r := range params.Ranges {
+		rq := Q{View: params.View, Start: r.Start, End: r.End, Prefix: r.Prefix}
+		start, end, prefix := stopWords(rq, ns)
+		resscans = append(resscans, scan{start: start, end: end, prefix: prefix, group: len(params.Keys) + i})
+	}
+	return
+}
+
+// errStop stops an iteration in itrFunc, without an error.
+var errStop = errors.New("stop iteration")
+
+// itemOf passes a single item to an iteration body.
+type itemOf struct{ item *badger.Item }
+
+func (i itemOf) Item() *badger.Item { return i.item }
+
 func itrFunc(txn *badger.Txn,
 	opt badger.IteratorOptions,
 	start, prefix []byte,
 	bodyFunc func(itr interface{ Item() *badger.Item }) error) error {
+	return itrFuncContext(context.Background(), txn, opt, start, prefix, bodyFunc)
+}
+
+// itrFuncContext is like itrFunc, and stops with ctx.Err() when ctx is done.
+func itrFuncContext(ctx context.Context,
+	txn *badger.Txn,
+	opt badger.IteratorOptions,
+	start, prefix []byte,
+	bodyFunc func(itr interface{ Item() *badger.Item }) error) error {
+	done := ctx.Done()
 	itr := txn.NewIterator(opt)
 	defer itr.Close()
 	for itr.Seek(start); itr.ValidForPrefix(prefix); itr.Next() {
+		select {
+		case <-done:
+			return ctx.Err()
+		default:
+		}
 		if err := bodyFunc(itr); err != nil {
+			if err == errStop {
+				return nil
+			}
 			return err
 		}
 	}
 	return nil
 }
 
+// inspector finds the id and rev fields of a document. A field is picked up
+// either by its json name or by a dockage tag, which takes precedence:
+//
+//	ID  string `json:"_id" dockage:"id"`
+//	Rev string `json:"_rev,omitempty" dockage:"rev"`
+//
+// Like encoding/json, shallower fields win over fields of embedded structs.
 type inspector struct {
 	id  string
+	fid *structs.Field
 	rev *structs.Field
+
+	idRank, revRank int
 }
 
-func (ins *inspector) inspect(v interface{}) {
+func (ins *inspector) inspect(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return ErrNoID
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return ErrNoID
+	}
 	list := structs.Fields(v)
-	ins.recinspect(list...)
+	ins.recinspect(0, list...)
+	// types are checked after all fields are ranked, so a field that loses
+	// to a dockage tag does not fail the document.
+	if ins.fid != nil {
+		fv := reflect.ValueOf(ins.fid.Value())
+		if fv.Kind() != reflect.String {
+			return fmt.Errorf("%w: field %s is %s", ErrInvalidIDType, ins.fid.Name(), fv.Kind())
+		}
+		ins.id = fv.String()
+	}
+	if ins.rev != nil {
+		if _, ok := ins.rev.Value().(string); !ok {
+			return fmt.Errorf("%w: field %s is %T", ErrInvalidRevType, ins.rev.Name(), ins.rev.Value())
+		}
+	}
+	return nil
 }
 
-func (ins *inspector) recinspect(fields ...*structs.Field) {
+func (ins *inspector) recinspect(depth int, fields ...*structs.Field) {
 	for _, fl := range fields {
-		if fl.IsEmbedded() {
-			ins.recinspect(fl.Fields()...)
+		if !fl.IsExported() {
+			continue
+		}
+		if fl.IsEmbedded() && tagName(fl.Tag("json")) == "" {
+			if canDescend(fl) {
+				ins.recinspect(depth+1, fl.Fields()...)
+			}
 			continue
 		}
-		dok := fl.Tag("json")
-		switch dok {
+		name, rank := fieldRole(fl, depth)
+		switch name {
 		case "id":
-			ins.id = fl.Value().(string)
+			if ins.idRank != 0 && ins.idRank <= rank {
+				continue
+			}
+			ins.fid = fl
+			ins.idRank = rank
 		case "rev":
+			if ins.revRank != 0 && ins.revRank <= rank {
+				continue
+			}
 			ins.rev = fl
+			ins.revRank = rank
+		}
+	}
+}
+
+// generateID fills the id field of doc with a new id from gen. The id must
+// be written back into the document, so doc must be a pointer.
+func (ins *inspector) generateID(doc interface{}, gen IDGenerator) error {
+	id, err := gen.NextID(doc)
+	if err != nil {
+		return err
+	}
+	ft := reflect.TypeOf(ins.fid.Value())
+	if err := ins.fid.Set(reflect.ValueOf(id).Convert(ft).Interface()); err != nil {
+		return fmt.Errorf("%w: %v", ErrIDNotSettable, err)
+	}
+	ins.id = id
+	return nil
+}
+
+// fieldRole returns the role of a field ("id", "rev" or anything else) and
+// its rank; lower ranks win. A dockage tag, at any depth, ranks above any
+// json tag; json tags are only a fallback.
+func fieldRole(fl *structs.Field, depth int) (name string, rank int) {
+	rank = depth + 1
+	if dok := fl.Tag("dockage"); dok != "" {
+		return tagName(dok), rank
+	}
+	return tagName(fl.Tag("json")), rank + jsonRank
+}
+
+// jsonRank is added to the rank of fields picked up by their json tag.
+const jsonRank = 1 << 16
+
+// tagName returns the name part of a struct tag, dropping options
+// like omitempty.
+func tagName(tag string) string {
+	if ix := strings.Index(tag, ","); ix >= 0 {
+		tag = tag[:ix]
+	}
+	return tag
+}
+
+// canDescend reports if an embedded field is a struct or a non-nil pointer
+// to a struct.
+func canDescend(fl *structs.Field) bool {
+	fv := reflect.ValueOf(fl.Value())
+	if fv.Kind() == reflect.Ptr {
+		if fv.IsNil() {
+			return false
 		}
+		fv = fv.Elem()
 	}
+	return fv.Kind() == reflect.Struct
 }
@@ -0,0 +1,111 @@
+package dockage
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+//-----------------------------------------------------------------------------
+
+// defaults of Options.GCInterval, GCDiscardRatio and GCMaxRuns
+const (
+	defaultGCInterval     = 10 * time.Minute
+	defaultGCDiscardRatio = 0.5
+	defaultGCMaxRuns      = 10
+)
+
+// startGC starts the maintenance loop, that garbage collects the value log
+// and folds the counters of views, every opt.GCInterval; stopped by
+// stopGC().
+func (db *DB) startGC(opt Options) {
+	db.gcRatio = opt.GCDiscardRatio
+	if db.gcRatio == 0 {
+		db.gcRatio = defaultGCDiscardRatio
+	}
+	interval := opt.GCInterval
+	if interval < 0 {
+		return
+	}
+	if interval == 0 {
+		interval = defaultGCInterval
+	}
+	maxRuns := opt.GCMaxRuns
+	if maxRuns == 0 {
+		maxRuns = defaultGCMaxRuns
+	}
+	db.gcStop = make(chan struct{})
+	db.gcDone.Add(1)
+	go func() {
+		defer db.gcDone.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-db.gcStop:
+				return
+			case <-ticker.C:
+			}
+			db.foldCounts()
+			for i := 0; i < maxRuns; i++ {
+				if db.runGC() != nil {
+					break
+				}
+				select {
+				case <-db.gcStop:
+					return
+				default:
+				}
+			}
+		}
+	}()
+}
+
+func (db *DB) stopGC() {
+	if db.gcStop == nil {
+		return
+	}
+	close(db.gcStop)
+	db.gcDone.Wait()
+	db.gcStop = nil
+}
+
+// runGC rewrites one value log file, if enough of it is stale; it returns
+// badger.ErrNoRewrite if there was none. Runs are serialized by gcMu,
+// because badger rejects a run while another one is going on.
+func (db *DB) runGC() error {
+	db.gcMu.Lock()
+	defer db.gcMu.Unlock()
+	start := time.Now()
+	err := db.db.RunValueLogGC(db.gcRatio)
+	if err == nil {
+		atomic.StoreInt64(&db.gcAt, time.Now().UnixNano())
+	}
+	db.obs.GCRun(time.Since(start), err)
+	return err
+}
+
+// Compact folds the counters of views and garbage collects the value log,
+// until no file has Options.GCDiscardRatio of stale data, to reclaim disk
+// space now, like after deleting many documents. It waits for a run of the
+// maintenance loop to end, instead of failing.
+func (db *DB) Compact() error {
+	if db.statsSq == nil {
+		return ErrReadOnly
+	}
+	if err := db.foldCounts(); err != nil {
+		return err
+	}
+	for {
+		err := db.runGC()
+		if err == badger.ErrNoRewrite {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,324 @@
+package dockage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/dgraph-io/badger"
+)
+
+//-----------------------------------------------------------------------------
+
+// GeoEmitter is passed to the function of a geo view, to emit the points
+// and boxes of a document.
+type GeoEmitter interface {
+	EmitPoint(lat, lng float64)
+	EmitBox(minLat, minLng, maxLat, maxLng float64)
+}
+
+// GeoFn function that emits the locations of a document.
+type GeoFn func(emitter GeoEmitter, id string, doc interface{})
+
+// NewGeoView creates a View that indexes points and boxes (in degrees) of
+// documents, to be queried by QueryBox(...) and QueryNear(...). Boxes must not
+// cross the antimeridian. Function geoFn must have no side effects.
+//
+// Locations are stored under Z-order keys: the latitude and longitude are
+// quantized to 32 bits each and their bits are interleaved, so nearby points
+// share key prefixes. A view key is a level byte followed by the 2*level
+// bits long cell of that level, big endian; points are stored at level 32
+// and boxes under up to four cells of the deepest level that covers them.
+func NewGeoView(name string, geoFn GeoFn) (resview View) {
+	if geoFn == nil {
+		panic("geoFn must be provided")
+	}
+	viewFn := func(emitter Emitter, id string, doc interface{}) (inf interface{}, err error) {
+		var gem geoEmitter
+		geoFn(&gem, id, doc)
+		for _, b := range gem.boxes {
+			if !b.valid() {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidLocation, b)
+			}
+			val := b.encode()
+			level, cells := b.cover(4)
+			for _, c := range cells {
+				emitter.Emit(geoKey(level, c), val)
+			}
+		}
+		return
+	}
+	resview = newView(name, viewFn)
+	resview.geo = true
+	return
+}
+
+type geoEmitter struct{ boxes []geoBox }
+
+func (gem *geoEmitter) EmitPoint(lat, lng float64) {
+	gem.boxes = append(gem.boxes, geoBox{lat, lng, lat, lng})
+}
+
+func (gem *geoEmitter) EmitBox(minLat, minLng, maxLat, maxLng float64) {
+	gem.boxes = append(gem.boxes, geoBox{minLat, minLng, maxLat, maxLng})
+}
+
+//-----------------------------------------------------------------------------
+
+const (
+	geoLevels    = 32
+	earthRadiusM = 6371008.8
+)
+
+// geoBox is a box, or a point if min and max are the same.
+type geoBox struct {
+	MinLat, MinLng, MaxLat, MaxLng float64
+}
+
+func (b geoBox) valid() bool {
+	return b.MinLat >= -90 && b.MaxLat <= 90 && b.MinLat <= b.MaxLat &&
+		b.MinLng >= -180 && b.MaxLng <= 180 && b.MinLng <= b.MaxLng
+}
+
+func (b geoBox) intersects(o geoBox) bool {
+	return b.MinLat <= o.MaxLat && o.MinLat <= b.MaxLat &&
+		b.MinLng <= o.MaxLng && o.MinLng <= b.MaxLng
+}
+
+// distance returns the distance in meters from a point to the nearest point
+// of the box.
+func (b geoBox) distance(lat, lng float64) float64 {
+	return haversine(lat, lng,
+		math.Max(b.MinLat, math.Min(lat, b.MaxLat)),
+		math.Max(b.MinLng, math.Min(lng, b.MaxLng)))
+}
+
+func (b geoBox) encode() []byte {
+	res := make([]byte, 32)
+	for i, f := range []float64{b.MinLat, b.MinLng, b.MaxLat, b.MaxLng} {
+		binary.BigEndian.PutUint64(res[i*8:], math.Float64bits(f))
+	}
+	return res
+}
+
+func decodeGeoBox(v []byte) (resbox geoBox, ok bool) {
+	if len(v) != 32 {
+		return
+	}
+	f := func(i int) float64 { return math.Float64frombits(binary.BigEndian.Uint64(v[i*8:])) }
+	return geoBox{f(0), f(1), f(2), f(3)}, true
+}
+
+// cover returns the deepest level, at which the box is covered by at most
+// max cells, and those cells.
+func (b geoBox) cover(max int) (level int, rescells []uint64) {
+	x0, y0 := quantize(b.MinLng, 180), quantize(b.MinLat, 90)
+	x1, y1 := quantize(b.MaxLng, 180), quantize(b.MaxLat, 90)
+	for level = geoLevels; level > 0; level-- {
+		s := uint(geoLevels - level)
+		nx, ny := int(x1>>s)-int(x0>>s)+1, int(y1>>s)-int(y0>>s)+1
+		if nx <= max && ny <= max && nx*ny <= max {
+			break
+		}
+	}
+	s := uint(geoLevels - level)
+	for x := x0 >> s; x <= x1>>s; x++ {
+		for y := y0 >> s; y <= y1>>s; y++ {
+			rescells = append(rescells, interleave(x, y))
+		}
+	}
+	return
+}
+
+// quantize maps v, in [-limit, limit], to 32 bits.
+func quantize(v, limit float64) uint32 {
+	q := (v + limit) / (2 * limit) * (1 << 32)
+	if q >= 1<<32 {
+		return math.MaxUint32
+	}
+	if q < 0 {
+		return 0
+	}
+	return uint32(q)
+}
+
+// interleave puts the bits of x (longitude) and y (latitude) one after
+// the other, x first.
+func interleave(x, y uint32) uint64 {
+	return spread(x)<<1 | spread(y)
+}
+
+func spread(v uint32) uint64 {
+	x := uint64(v)
+	x = (x | x<<16) & 0x0000ffff0000ffff
+	x = (x | x<<8) & 0x00ff00ff00ff00ff
+	x = (x | x<<4) & 0x0f0f0f0f0f0f0f0f
+	x = (x | x<<2) & 0x3333333333333333
+	x = (x | x<<1) & 0x5555555555555555
+	return x
+}
+
+func geoKey(level int, cell uint64) []byte {
+	k := make([]byte, 9)
+	k[0] = byte(level)
+	binary.BigEndian.PutUint64(k[1:], cell)
+	return k
+}
+
+func haversine(lat1, lng1, lat2, lng2 float64) float64 {
+	rad := math.Pi / 180
+	dlat := (lat2 - lat1) * rad
+	dlng := (lng2 - lng1) * rad
+	a := math.Sin(dlat/2)*math.Sin(dlat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dlng/2)*math.Sin(dlng/2)
+	return 2 * earthRadiusM * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+//-----------------------------------------------------------------------------
+
+// GeoRes is a document found by QueryBox(...) or QueryNear(...), with
+// the emitted location that matched. For a point, Min and Max are the same.
+type GeoRes struct {
+	ID                             string
+	MinLat, MinLng, MaxLat, MaxLng float64
+	// Distance in meters, from the center of QueryNear(...) to the location;
+	// for a box, to its nearest corner or edge.
+	Distance float64
+}
+
+// QueryBox finds documents with a location inside or overlapping a box,
+// sorted by id. Each document is returned once.
+func (db *DB) QueryBox(view string, minLat, minLng, maxLat, maxLng float64) (reslist []GeoRes, reserr error) {
+	q := geoBox{minLat, minLng, maxLat, maxLng}
+	if !q.valid() {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidLocation, q)
+	}
+	found := make(map[string]GeoRes)
+	reserr = db.scanGeo(view, q, func(id string, b geoBox) {
+		if _, ok := found[id]; ok || !b.intersects(q) {
+			return
+		}
+		found[id] = GeoRes{ID: id, MinLat: b.MinLat, MinLng: b.MinLng, MaxLat: b.MaxLat, MaxLng: b.MaxLng}
+	})
+	if reserr != nil {
+		return nil, reserr
+	}
+	for _, r := range found {
+		reslist = append(reslist, r)
+	}
+	sort.Slice(reslist, func(i, j int) bool { return reslist[i].ID < reslist[j].ID })
+	return
+}
+
+// QueryNear finds documents with a location within radius meters of a point,
+// nearest first. Each document is returned once, with its nearest location.
+func (db *DB) QueryNear(view string, lat, lng, radius float64, limit int) (reslist []GeoRes, reserr error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	center := geoBox{lat, lng, lat, lng}
+	if !center.valid() || radius < 0 {
+		return nil, fmt.Errorf("%w: %v radius %v", ErrInvalidLocation, center, radius)
+	}
+	// the box around the circle
+	dlat := radius / earthRadiusM * 180 / math.Pi
+	q := geoBox{math.Max(-90, lat-dlat), -180, math.Min(90, lat+dlat), 180}
+	if sinr, coslat := math.Sin(radius/earthRadiusM), math.Cos(lat*math.Pi/180); q.MinLat > -90 && q.MaxLat < 90 && sinr < coslat {
+		dlng := math.Asin(sinr/coslat) * 180 / math.Pi
+		if lng-dlng >= -180 && lng+dlng <= 180 {
+			q.MinLng, q.MaxLng = lng-dlng, lng+dlng
+		}
+	}
+	found := make(map[string]GeoRes)
+	reserr = db.scanGeo(view, q, func(id string, b geoBox) {
+		d := b.distance(lat, lng)
+		if d > radius {
+			return
+		}
+		if prev, ok := found[id]; ok && prev.Distance <= d {
+			return
+		}
+		found[id] = GeoRes{ID: id, MinLat: b.MinLat, MinLng: b.MinLng, MaxLat: b.MaxLat, MaxLng: b.MaxLng, Distance: d}
+	})
+	if reserr != nil {
+		return nil, reserr
+	}
+	for _, r := range found {
+		reslist = append(reslist, r)
+	}
+	sort.Slice(reslist, func(i, j int) bool {
+		if reslist[i].Distance != reslist[j].Distance {
+			return reslist[i].Distance < reslist[j].Distance
+		}
+		return reslist[i].ID < reslist[j].ID
+	})
+	if len(reslist) > limit {
+		reslist = reslist[:limit]
+	}
+	return
+}
+
+// scanGeo passes the locations stored in cells that overlap box q to fn.
+// q is covered by a few cells of one level; at deeper levels the keys inside
+// those cells are scanned as ranges, at coarser levels their ancestors are
+// read.
+func (db *DB) scanGeo(view string, q geoBox, fn func(id string, b geoBox)) error {
+	vw, ok := db.views.find(view)
+	if !ok || !vw.geo {
+		return ErrViewNotFound
+	}
+	level, cells := q.cover(16)
+	pfx := []byte(pat4View(vw.ns + viewx2k))
+	return db.view("query_geo", func(txn *badger.Txn) error {
+		opt := badger.DefaultIteratorOptions
+		body := func(end []byte) func(itr interface{ Item() *badger.Item }) error {
+			return func(itr interface{ Item() *badger.Item }) error {
+				item := itr.Item()
+				if end != nil && bytes.Compare(item.Key(), end) > 0 {
+					return errStop
+				}
+				_, id := splitViewKey(item.Key())
+				v, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				if b, ok := decodeGeoBox(v); ok {
+					fn(string(id), b)
+				}
+				return nil
+			}
+		}
+		seen := make(map[string]bool)
+		for m := 0; m <= geoLevels; m++ {
+			for _, c := range cells {
+				if m < level {
+					k := appendSegment(pfx[:len(pfx):len(pfx)], geoKey(m, c>>uint(2*(level-m))))
+					if seen[string(k)] {
+						continue
+					}
+					seen[string(k)] = true
+					if err := itrFunc(txn, opt, k, k, body(nil)); err != nil {
+						return err
+					}
+					continue
+				}
+				shift := uint(2 * (m - level))
+				first, last := c<<shift, (c+1)<<shift-1
+				if shift == 64 {
+					first, last = 0, math.MaxUint64
+				}
+				start := appendEscaped(pfx[:len(pfx):len(pfx)], geoKey(m, first))
+				// past the terminator of the last cell, before any escaped byte
+				end := append(appendEscaped(pfx[:len(pfx):len(pfx)], geoKey(m, last)), 0x00, segterm+1)
+				if err := itrFunc(txn, opt, start, pfx, body(end)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,424 @@
+// Package httpapi serves a dockage database over HTTP, with a CouchDB like
+// REST API:
+//
+//	GET    /docs/{id}     the document, its rev in ETag
+//	PUT    /docs/{id}     store a document, rev from If-Match or the body;
+//	                      201 if it is created, 200 if it is updated;
+//	                      409 for a rev of a document that does not exist
+//	DELETE /docs/{id}     delete a document, rev from If-Match or ?rev=
+//	POST   /bulk          store {"docs": [...]} in one transaction
+//	GET    /views/{name}  query a view, ?start=&end=&prefix=&limit=&skip=
+//	GET    /changes       changes, ?since=&limit=&feed=normal|longpoll|eventsource
+//
+// Documents are json objects with "id" and "rev" fields, stored as
+// *dockage.RawDoc. Errors are json objects {"error": ..., "reason": ...},
+// with status 404 for missing documents and 409 for rev conflicts.
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dc0d/dockage"
+)
+
+//-----------------------------------------------------------------------------
+
+// Handler is an http.Handler over a database.
+type Handler struct {
+	db *dockage.DB
+	// PollInterval is how often long poll and event source feeds look for
+	// changes, default 250ms.
+	PollInterval time.Duration
+	// Timeout is the longest a long poll feed waits, default 60s; a request
+	// can ask for less by ?timeout= in milliseconds.
+	Timeout time.Duration
+	// MaxBody is the largest request body, in bytes, default 8MB.
+	MaxBody int64
+}
+
+// NewHandler creates a Handler over db.
+func NewHandler(db *dockage.DB) *Handler {
+	return &Handler{
+		db:           db,
+		PollInterval: 250 * time.Millisecond,
+		Timeout:      60 * time.Second,
+		MaxBody:      8 << 20,
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil && h.MaxBody > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, h.MaxBody)
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	route, rest := path, ""
+	if ix := strings.Index(path, "/"); ix >= 0 {
+		route, rest = path[:ix], path[ix+1:]
+	}
+	switch {
+	case route == "docs" && rest != "":
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			h.getDoc(w, r, rest)
+		case http.MethodPut:
+			h.putDoc(w, r, rest)
+		case http.MethodDelete:
+			h.deleteDoc(w, r, rest)
+		default:
+			methodNotAllowed(w, "GET, HEAD, PUT, DELETE")
+		}
+	case route == "bulk" && rest == "":
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, "POST")
+			return
+		}
+		h.bulk(w, r)
+	case route == "views" && rest != "":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		h.queryView(w, r, rest)
+	case route == "changes" && rest == "":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		h.changes(w, r)
+	default:
+		writeError(w, http.StatusNotFound, "not_found", "no such route")
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+type docRev struct {
+	OK  bool   `json:"ok"`
+	ID  string `json:"id"`
+	Rev string `json:"rev"`
+}
+
+func (h *Handler) getDoc(w http.ResponseWriter, r *http.Request, id string) {
+	list, err := h.db.GetManyContext(r.Context(), []string{id}, dockage.GetOptions{})
+	if err == nil {
+		err = list[0].Err
+	}
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	var doc dockage.RawDoc
+	if err := json.Unmarshal(list[0].Doc, &doc); err == nil && doc.Rev != "" {
+		etag := strconv.Quote(doc.Rev)
+		w.Header().Set("ETag", etag)
+		if match := r.Header.Get("If-None-Match"); match == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(list[0].Doc)
+}
+
+func (h *Handler) putDoc(w http.ResponseWriter, r *http.Request, id string) {
+	var doc dockage.RawDoc
+	if err := json.NewDecoder(r.Body).Decode(&doc); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	if doc.ID != "" && doc.ID != id {
+		writeError(w, http.StatusBadRequest, "bad_request", "id of document does not match the url")
+		return
+	}
+	doc.ID = id
+	if rev, ok := ifMatch(r); ok {
+		doc.Rev = rev
+	}
+	// a rev is given to update a document, otherwise it is created; as in
+	// CouchDB, a rev for a document that does not exist is a conflict
+	status := http.StatusCreated
+	if doc.Rev != "" {
+		list, err := h.db.GetManyContext(r.Context(), []string{id}, dockage.GetOptions{})
+		if err == nil && errors.Is(list[0].Err, dockage.ErrNotFound) {
+			writeError(w, http.StatusConflict, "conflict", "rev is given for a document that does not exist")
+			return
+		}
+		if err == nil {
+			err = list[0].Err
+		}
+		if err != nil {
+			writeErr(w, err)
+			return
+		}
+		status = http.StatusOK
+	}
+	if err := h.db.PutContext(r.Context(), &doc); err != nil {
+		writeErr(w, err)
+		return
+	}
+	w.Header().Set("ETag", strconv.Quote(doc.Rev))
+	writeJSON(w, status, docRev{OK: true, ID: doc.ID, Rev: doc.Rev})
+}
+
+func (h *Handler) deleteDoc(w http.ResponseWriter, r *http.Request, id string) {
+	rev, ok := ifMatch(r)
+	if !ok {
+		rev = r.URL.Query().Get("rev")
+	}
+	if rev == "" {
+		writeError(w, http.StatusConflict, "conflict", "rev is needed, by If-Match or ?rev=")
+		return
+	}
+	if err := h.db.DeleteRevContext(r.Context(), id, rev); err != nil {
+		writeErr(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, docRev{OK: true, ID: id, Rev: rev})
+}
+
+// ifMatch returns the rev of the If-Match header.
+func ifMatch(r *http.Request) (string, bool) {
+	v := strings.TrimSpace(r.Header.Get("If-Match"))
+	if v == "" {
+		return "", false
+	}
+	v = strings.TrimPrefix(v, "W/")
+	if s, err := strconv.Unquote(v); err == nil {
+		v = s
+	}
+	return v, true
+}
+
+func (h *Handler) bulk(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Docs []*dockage.RawDoc `json:"docs"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	docs := make([]interface{}, len(req.Docs))
+	for i, d := range req.Docs {
+		if d == nil {
+			writeError(w, http.StatusBadRequest, "bad_request", fmt.Sprintf("document %d is null", i))
+			return
+		}
+		docs[i] = d
+	}
+	if err := h.db.PutContext(r.Context(), docs...); err != nil {
+		writeErr(w, err)
+		return
+	}
+	res := make([]docRev, len(req.Docs))
+	for i, d := range req.Docs {
+		res[i] = docRev{OK: true, ID: d.ID, Rev: d.Rev}
+	}
+	writeJSON(w, http.StatusCreated, res)
+}
+
+//-----------------------------------------------------------------------------
+
+type viewRow struct {
+	ID    string          `json:"id"`
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+func (h *Handler) queryView(w http.ResponseWriter, r *http.Request, view string) {
+	qs := r.URL.Query()
+	q := dockage.Q{View: view}
+	for _, v := range []struct {
+		name string
+		p    *[]byte
+	}{{"start", &q.Start}, {"end", &q.End}, {"prefix", &q.Prefix}} {
+		if s := qs.Get(v.name); s != "" {
+			*v.p = []byte(s)
+		}
+	}
+	var err error
+	if q.Limit, err = intParam(qs.Get("limit")); err == nil {
+		q.Skip, err = intParam(qs.Get("skip"))
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	list, _, err := h.db.QueryContext(r.Context(), q)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	rows := make([]viewRow, 0, len(list))
+	for _, res := range list {
+		row := viewRow{ID: string(res.Key), Key: string(res.Index), Value: res.Val}
+		if len(res.Val) == 0 {
+			row.Value = json.RawMessage("null")
+		} else if !json.Valid(res.Val) {
+			row.Value, _ = json.Marshal(string(res.Val))
+		}
+		rows = append(rows, row)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"rows": rows})
+}
+
+//-----------------------------------------------------------------------------
+
+type change struct {
+	Seq     string `json:"seq"`
+	ID      string `json:"id"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+func (h *Handler) changes(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	since := qs.Get("since")
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		since = id
+	}
+	limit, err := intParam(qs.Get("limit"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	timeout := h.Timeout
+	if ms, err := intParam(qs.Get("timeout")); err == nil && ms > 0 && time.Duration(ms)*time.Millisecond < timeout {
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+	switch feed := qs.Get("feed"); feed {
+	case "", "normal", "longpoll":
+		var deadline <-chan time.Time
+		if feed == "longpoll" {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+		list, last, err := h.poll(r, since, limit, deadline)
+		if err != nil {
+			writeErr(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"results": list, "last_seq": last})
+	case "eventsource":
+		h.eventSource(w, r, since, limit)
+	default:
+		writeError(w, http.StatusBadRequest, "bad_request", "unknown feed "+feed)
+	}
+}
+
+// poll reads changes after since. If there are none and deadline is not nil,
+// it waits for them, until deadline or the request is done.
+func (h *Handler) poll(r *http.Request, since string, limit int, deadline <-chan time.Time) (reslist []change, reslast string, reserr error) {
+	ticker := time.NewTicker(h.PollInterval)
+	defer ticker.Stop()
+	reslast, reslist = since, []change{}
+	for {
+		list, err := h.db.Changes(reslast, limit)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, c := range list {
+			reslist = append(reslist, change{Seq: c.Seq, ID: c.ID, Deleted: c.Deleted})
+			reslast = c.Seq
+		}
+		if len(reslist) > 0 || deadline == nil {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// eventSource streams changes as server-sent events, until the request is
+// done. The id of an event is its seq, so a client continues after it
+// reconnects.
+func (h *Handler) eventSource(w http.ResponseWriter, r *http.Request, since string, limit int) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "internal", "streaming is not supported")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		list, last, err := h.poll(r, since, limit, make(chan time.Time))
+		if err != nil {
+			fmt.Fprintf(w, "event: error\ndata: %q\n\n", err.Error())
+			flusher.Flush()
+			return
+		}
+		if len(list) == 0 {
+			return // the request is done
+		}
+		for _, c := range list {
+			data, _ := json.Marshal(c)
+			if _, err := fmt.Fprintf(w, "id: %s\ndata: %s\n\n", c.Seq, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+		since = last
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+func intParam(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return n, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code, reason string) {
+	writeJSON(w, status, map[string]string{"error": code, "reason": reason})
+}
+
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "allowed: "+allow)
+}
+
+// writeErr writes an error of the database, with its status.
+func writeErr(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, dockage.ErrNotFound):
+		writeError(w, http.StatusNotFound, "not_found", err.Error())
+	case errors.Is(err, dockage.ErrNoMatchRev), errors.Is(err, dockage.ErrUniqueViolation):
+		writeError(w, http.StatusConflict, "conflict", err.Error())
+	case errors.Is(err, dockage.ErrNoID), errors.Is(err, dockage.ErrNoRev),
+		errors.Is(err, dockage.ErrInvalidIDType), errors.Is(err, dockage.ErrInvalidRevType):
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+	case errors.Is(err, dockage.ErrReadOnly):
+		writeError(w, http.StatusForbidden, "forbidden", err.Error())
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		writeError(w, http.StatusServiceUnavailable, "canceled", err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, "internal", err.Error())
+	}
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,232 @@
+package httpapi
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dc0d/dockage"
+	"github.com/stretchr/testify/require"
+)
+
+func createDB(t *testing.T) *dockage.DB {
+	dir, err := ioutil.TempDir(os.TempDir(), "httpapi")
+	require.NoError(t, err)
+	db, err := dockage.Open(dockage.Options{Dir: dir, ValueDir: dir})
+	require.NoError(t, err)
+	require.NoError(t, db.AddView(dockage.NewView("tags",
+		func(em dockage.Emitter, id string, doc interface{}) {
+			d, ok := doc.(*dockage.RawDoc)
+			if !ok {
+				return
+			}
+			var tags []string
+			json.Unmarshal(d.Field("tags"), &tags)
+			for _, v := range tags {
+				em.Emit([]byte(v), []byte(`{"n":1}`))
+			}
+		})))
+	return db
+}
+
+func do(h http.Handler, method, target, body string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func decode(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), v))
+}
+
+func TestDocs(t *testing.T) {
+	require := require.New(t)
+	db := createDB(t)
+	defer db.Close()
+	h := NewHandler(db)
+
+	w := do(h, "PUT", "/docs/P1", `{"title":"one","tags":["go"]}`)
+	require.Equal(http.StatusCreated, w.Code)
+	var created docRev
+	decode(t, w, &created)
+	require.Equal("P1", created.ID)
+	etag := w.Header().Get("ETag")
+	require.Equal(`"`+created.Rev+`"`, etag)
+
+	w = do(h, "GET", "/docs/P1", "")
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal(etag, w.Header().Get("ETag"))
+	var doc map[string]interface{}
+	decode(t, w, &doc)
+	require.Equal("one", doc["title"])
+	require.Equal(created.Rev, doc["rev"])
+	w = do(h, "GET", "/docs/P1", "", "If-None-Match", etag)
+	require.Equal(http.StatusNotModified, w.Code)
+
+	// conflicts
+	w = do(h, "PUT", "/docs/P1", `{"title":"two"}`)
+	require.Equal(http.StatusConflict, w.Code)
+	var e map[string]string
+	decode(t, w, &e)
+	require.Equal("conflict", e["error"])
+	w = do(h, "PUT", "/docs/P1", `{"title":"two"}`, "If-Match", `"bad"`)
+	require.Equal(http.StatusConflict, w.Code)
+	w = do(h, "PUT", "/docs/P1", `{"title":"two","tags":["db"]}`, "If-Match", etag)
+	require.Equal(http.StatusOK, w.Code)
+	require.NotEqual(etag, w.Header().Get("ETag"))
+	etag = w.Header().Get("ETag")
+	rev, _ := strconv.Unquote(etag)
+	w = do(h, "PUT", "/docs/P1", `{"title":"two","tags":["db"],"rev":"`+rev+`"}`)
+	require.Equal(http.StatusOK, w.Code)
+	etag = w.Header().Get("ETag")
+
+	// a rev for a document that does not exist
+	w = do(h, "PUT", "/docs/P3", `{"title":"three"}`, "If-Match", etag)
+	require.Equal(http.StatusConflict, w.Code)
+	w = do(h, "PUT", "/docs/P3", `{"title":"three","rev":"`+rev+`"}`)
+	require.Equal(http.StatusConflict, w.Code)
+	require.Equal(http.StatusNotFound, do(h, "GET", "/docs/P3", "").Code)
+
+	w = do(h, "PUT", "/docs/P1", `{"id":"P2"}`)
+	require.Equal(http.StatusBadRequest, w.Code)
+	w = do(h, "PUT", "/docs/P1", `[1]`)
+	require.Equal(http.StatusBadRequest, w.Code)
+
+	w = do(h, "DELETE", "/docs/P1", "")
+	require.Equal(http.StatusConflict, w.Code)
+	w = do(h, "DELETE", "/docs/P1?rev=bad", "")
+	require.Equal(http.StatusConflict, w.Code)
+	w = do(h, "DELETE", "/docs/P1", "", "If-Match", etag)
+	require.Equal(http.StatusOK, w.Code)
+	w = do(h, "GET", "/docs/P1", "")
+	require.Equal(http.StatusNotFound, w.Code)
+	decode(t, w, &e)
+	require.Equal("not_found", e["error"])
+	w = do(h, "DELETE", "/docs/P1", "", "If-Match", etag)
+	require.Equal(http.StatusNotFound, w.Code)
+
+	require.Equal(http.StatusNotFound, do(h, "GET", "/nothing", "").Code)
+	require.Equal(http.StatusMethodNotAllowed, do(h, "GET", "/bulk", "").Code)
+}
+
+func TestBulkAndViews(t *testing.T) {
+	require := require.New(t)
+	db := createDB(t)
+	defer db.Close()
+	h := NewHandler(db)
+
+	w := do(h, "POST", "/bulk", `{"docs":[{"id":"A","tags":["go","db"]},{"id":"B","tags":["go"]}]}`)
+	require.Equal(http.StatusCreated, w.Code)
+	var revs []docRev
+	decode(t, w, &revs)
+	require.Len(revs, 2)
+	require.Equal("B", revs[1].ID)
+
+	// all or nothing
+	w = do(h, "POST", "/bulk", `{"docs":[{"id":"C"},{"id":"A"}]}`)
+	require.Equal(http.StatusConflict, w.Code)
+	require.Equal(http.StatusNotFound, do(h, "GET", "/docs/C", "").Code)
+
+	w = do(h, "GET", "/views/tags?prefix=go", "")
+	require.Equal(http.StatusOK, w.Code)
+	var res struct{ Rows []viewRow }
+	decode(t, w, &res)
+	require.Len(res.Rows, 2)
+	require.Equal("A", res.Rows[0].ID)
+	require.Equal("go", res.Rows[0].Key)
+	require.JSONEq(`{"n":1}`, string(res.Rows[0].Value))
+
+	w = do(h, "GET", "/views/tags?start=d&limit=1&skip=1", "")
+	decode(t, w, &res)
+	require.Len(res.Rows, 1)
+	require.Equal("A", res.Rows[0].ID)
+	require.Equal("go", res.Rows[0].Key)
+	require.Equal(http.StatusBadRequest, do(h, "GET", "/views/tags?limit=x", "").Code)
+
+	// an aborted request
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequest("GET", "/views/tags?prefix=go", nil).WithContext(ctx)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	require.Equal(http.StatusServiceUnavailable, w.Code)
+}
+
+func TestChanges(t *testing.T) {
+	require := require.New(t)
+	db := createDB(t)
+	defer db.Close()
+	h := NewHandler(db)
+	h.PollInterval = 10 * time.Millisecond
+
+	do(h, "POST", "/bulk", `{"docs":[{"id":"A"},{"id":"B"}]}`)
+	type feed struct {
+		Results []change
+		LastSeq string `json:"last_seq"`
+	}
+	var f feed
+	decode(t, do(h, "GET", "/changes", ""), &f)
+	require.Len(f.Results, 2)
+	require.Equal("A", f.Results[0].ID)
+	since := f.LastSeq
+
+	decode(t, do(h, "GET", "/changes?since="+since, ""), &f)
+	require.Empty(f.Results)
+	require.Equal(since, f.LastSeq)
+
+	// long poll waits for the next change
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		db.Put(&dockage.RawDoc{ID: "C"})
+	}()
+	decode(t, do(h, "GET", "/changes?feed=longpoll&timeout=5000&since="+since, ""), &f)
+	require.Len(f.Results, 1)
+	require.Equal("C", f.Results[0].ID)
+	since = f.LastSeq
+
+	start := time.Now()
+	decode(t, do(h, "GET", "/changes?feed=longpoll&timeout=30&since="+since, ""), &f)
+	require.Empty(f.Results)
+	require.True(time.Since(start) < time.Second)
+
+	// deletions
+	require.NoError(db.Delete("A"))
+	decode(t, do(h, "GET", "/changes?since="+since, ""), &f)
+	require.Equal([]change{{Seq: f.LastSeq, ID: "A", Deleted: true}}, f.Results)
+	w := do(h, "GET", "/changes?since="+since, "")
+	require.Contains(w.Body.String(), `"deleted":true`)
+	since = f.LastSeq
+
+	// server-sent events
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequest("GET", srv.URL+"/changes?feed=eventsource", nil)
+	require.NoError(err)
+	req.Header.Set("Last-Event-ID", since)
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	require.NoError(err)
+	defer resp.Body.Close()
+	require.Equal("text/event-stream", resp.Header.Get("Content-Type"))
+	require.NoError(db.Put(&dockage.RawDoc{ID: "D"}))
+	sc := bufio.NewScanner(resp.Body)
+	var lines []string
+	for sc.Scan() && len(lines) < 2 {
+		lines = append(lines, sc.Text())
+	}
+	require.True(strings.HasPrefix(lines[0], "id: "))
+	require.Contains(lines[1], `"id":"D"`)
+}
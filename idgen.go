@@ -0,0 +1,168 @@
+package dockage
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+//-----------------------------------------------------------------------------
+
+// IDGenerator generates ids for documents that are put without one. The id
+// field must exist in the document (it is just empty) and the document must
+// be passed to Put as a pointer, so the generated id can be written back.
+type IDGenerator interface {
+	NextID(doc interface{}) (string, error)
+}
+
+// IDGeneratorFunc adapts a function to IDGenerator.
+type IDGeneratorFunc func(doc interface{}) (string, error)
+
+// NextID calls fn(doc).
+func (fn IDGeneratorFunc) NextID(doc interface{}) (string, error) { return fn(doc) }
+
+// dbBinder is implemented by generators that keep their state inside
+// the database. Open binds them and Close releases them.
+type dbBinder interface {
+	bind(bdb *badger.DB) error
+	release() error
+}
+
+//-----------------------------------------------------------------------------
+
+// NewUUIDGenerator creates an IDGenerator that generates random (version 4)
+// UUIDs, like 1699dc18-e717-4875-9cea-d736ce3dfa05.
+func NewUUIDGenerator() IDGenerator {
+	return IDGeneratorFunc(func(interface{}) (string, error) {
+		var u [16]byte
+		if _, err := io.ReadFull(rand.Reader, u[:]); err != nil {
+			return "", err
+		}
+		u[6] = (u[6] & 0x0f) | 0x40
+		u[8] = (u[8] & 0x3f) | 0x80
+		var buf [36]byte
+		hex.Encode(buf[0:8], u[0:4])
+		buf[8] = '-'
+		hex.Encode(buf[9:13], u[4:6])
+		buf[13] = '-'
+		hex.Encode(buf[14:18], u[6:8])
+		buf[18] = '-'
+		hex.Encode(buf[19:23], u[8:10])
+		buf[23] = '-'
+		hex.Encode(buf[24:], u[10:])
+		return string(buf[:]), nil
+	})
+}
+
+//-----------------------------------------------------------------------------
+
+// NewULIDGenerator creates an IDGenerator that generates ULIDs: 26 character,
+// time-ordered ids. Ids generated in the same millisecond by the same
+// generator are still in increasing order.
+func NewULIDGenerator() IDGenerator {
+	return &ulidGenerator{now: time.Now}
+}
+
+type ulidGenerator struct {
+	mx      sync.Mutex
+	now     func() time.Time
+	lastMS  uint64
+	entropy [10]byte
+}
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+func (g *ulidGenerator) NextID(interface{}) (string, error) {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	ms := uint64(g.now().UnixNano() / int64(time.Millisecond))
+	if ms <= g.lastMS {
+		ms = g.lastMS
+		if !incEntropy(g.entropy[:]) {
+			ms++
+		}
+	} else {
+		if _, err := io.ReadFull(rand.Reader, g.entropy[:]); err != nil {
+			return "", err
+		}
+	}
+	g.lastMS = ms
+
+	var u [16]byte
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], ms)
+	copy(u[:6], ts[2:])
+	copy(u[6:], g.entropy[:])
+	return encodeULID(u), nil
+}
+
+// incEntropy increments the random part by one, reporting false on overflow.
+func incEntropy(b []byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeULID encodes 128 bits as 26 characters of Crockford's base32.
+func encodeULID(u [16]byte) string {
+	var buf [26]byte
+	hi := binary.BigEndian.Uint64(u[:8])
+	lo := binary.BigEndian.Uint64(u[8:])
+	for i := 25; i >= 0; i-- {
+		buf[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(buf[:])
+}
+
+//-----------------------------------------------------------------------------
+
+// NewSequenceIDGenerator creates an IDGenerator that generates ids made of
+// prefix and a database-wide sequence number, like POST:000000000000002a.
+// The sequence is persisted, so a generator must be used with only one
+// database.
+func NewSequenceIDGenerator(prefix string) IDGenerator {
+	return &seqGenerator{prefix: prefix}
+}
+
+type seqGenerator struct {
+	prefix string
+	sq     *badger.Sequence
+}
+
+func (g *seqGenerator) bind(bdb *badger.DB) (reserr error) {
+	g.sq, reserr = bdb.GetSequence([]byte(pat4Sys(idseq, g.prefix)), 128)
+	return
+}
+
+func (g *seqGenerator) release() error {
+	if g.sq == nil {
+		return nil
+	}
+	return g.sq.Release()
+}
+
+func (g *seqGenerator) NextID(interface{}) (string, error) {
+	if g.sq == nil {
+		return "", fmt.Errorf("sequence id generator %q is not bound to a database", g.prefix)
+	}
+	n, err := g.sq.Next()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%016x", g.prefix, n), nil
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,362 @@
+// Package keys encodes tuples of values into byte strings, whose
+// lexicographic order is the same as the order of the values. It is meant for
+// building view keys, that sort correctly, even for negative numbers, mixed
+// types and multi-part keys.
+//
+// Values are ordered like CouchDB collation:
+//
+//	nil < false < true < numbers < strings < times < arrays < objects
+//
+// Numbers (ints and floats) compare by value. Strings compare byte by byte.
+// Arrays compare element by element, a shorter array sorts first.
+package keys
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// type tags, their order is the order of types
+const (
+	tagEnd    = 0x00
+	tagNull   = 0x05
+	tagFalse  = 0x10
+	tagTrue   = 0x11
+	tagNumber = 0x20
+	tagString = 0x30
+	tagTime   = 0x40
+	tagArray  = 0x50
+	tagObject = 0x60
+)
+
+// errors
+var (
+	ErrUnsupported = errors.New("unsupported type")
+	ErrInvalid     = errors.New("invalid encoded key")
+)
+
+// Encode encodes a tuple of values. Supported types are nil, bool, all int,
+// uint and float types, json.Number, string, []byte (encoded as a string),
+// time.Time, slices and arrays of supported types and map[string]interface{}.
+func Encode(values ...interface{}) ([]byte, error) {
+	return Append(nil, values...)
+}
+
+// MustEncode is like Encode but panics on error. It is handy inside view
+// functions, with values of known types.
+func MustEncode(values ...interface{}) []byte {
+	k, err := Encode(values...)
+	if err != nil {
+		panic(err)
+	}
+	return k
+}
+
+// Append appends the encoded tuple of values to dst.
+func Append(dst []byte, values ...interface{}) ([]byte, error) {
+	for _, v := range values {
+		var err error
+		if dst, err = appendValue(dst, v); err != nil {
+			return nil, err
+		}
+	}
+	return dst, nil
+}
+
+// Prefix encodes values to be used as a prefix in range queries. It is like
+// Encode, except when the last value is a string or an array, which is left
+// open: Prefix("go") matches "go", "golang" and "gozoo" and
+// Prefix([]interface{}{"a"}) matches all arrays starting with "a".
+func Prefix(values ...interface{}) ([]byte, error) {
+	k, err := Encode(values...)
+	if err != nil || len(values) == 0 {
+		return k, err
+	}
+	switch last := values[len(values)-1].(type) {
+	case string, []byte:
+		return k[:len(k)-2], nil
+	case map[string]interface{}:
+		return k, nil
+	default:
+		kind := reflect.ValueOf(last).Kind()
+		if kind == reflect.Slice || kind == reflect.Array {
+			return k[:len(k)-1], nil
+		}
+	}
+	return k, nil
+}
+
+func appendValue(dst []byte, v interface{}) ([]byte, error) {
+	switch x := v.(type) {
+	case nil:
+		return append(dst, tagNull), nil
+	case bool:
+		if x {
+			return append(dst, tagTrue), nil
+		}
+		return append(dst, tagFalse), nil
+	case json.Number:
+		if n, err := strconv.ParseInt(string(x), 10, 64); err == nil {
+			return appendInt(dst, n), nil
+		}
+		f, err := x.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return appendFloat(dst, f)
+	case float64:
+		return appendFloat(dst, x)
+	case float32:
+		return appendFloat(dst, float64(x))
+	case int:
+		return appendInt(dst, int64(x)), nil
+	case int64:
+		return appendInt(dst, x), nil
+	case int32:
+		return appendInt(dst, int64(x)), nil
+	case int16:
+		return appendInt(dst, int64(x)), nil
+	case int8:
+		return appendInt(dst, int64(x)), nil
+	case uint, uint64, uint32, uint16, uint8:
+		u := reflect.ValueOf(x).Uint()
+		if u > math.MaxInt64 {
+			return nil, fmt.Errorf("%w: uint64 %d is out of int64 range", ErrUnsupported, u)
+		}
+		return appendInt(dst, int64(u)), nil
+	case string:
+		return appendString(append(dst, tagString), x), nil
+	case []byte:
+		return appendString(append(dst, tagString), string(x)), nil
+	case time.Time:
+		var buf [12]byte
+		binary.BigEndian.PutUint64(buf[:8], uint64(x.Unix())^(1<<63))
+		binary.BigEndian.PutUint32(buf[8:], uint32(x.Nanosecond()))
+		return append(append(dst, tagTime), buf[:]...), nil
+	case []interface{}:
+		dst = append(dst, tagArray)
+		for _, elem := range x {
+			var err error
+			if dst, err = appendValue(dst, elem); err != nil {
+				return nil, err
+			}
+		}
+		return append(dst, tagEnd), nil
+	case map[string]interface{}:
+		names := make([]string, 0, len(x))
+		for k := range x {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		dst = append(dst, tagObject)
+		for _, k := range names {
+			dst = appendString(append(dst, tagString), k)
+			var err error
+			if dst, err = appendValue(dst, x[k]); err != nil {
+				return nil, err
+			}
+		}
+		return append(dst, tagEnd), nil
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array {
+		dst = append(dst, tagArray)
+		for i := 0; i < rv.Len(); i++ {
+			var err error
+			if dst, err = appendValue(dst, rv.Index(i).Interface()); err != nil {
+				return nil, err
+			}
+		}
+		return append(dst, tagEnd), nil
+	}
+	return nil, fmt.Errorf("%w: %T", ErrUnsupported, v)
+}
+
+// appendString escapes 0x00 as 0x00 0xff and terminates the string
+// with 0x00 0x01, so a string sorts before any longer string it prefixes.
+func appendString(dst []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		if s[i] == 0x00 {
+			dst = append(dst, 0x00, 0xff)
+			continue
+		}
+		dst = append(dst, s[i])
+	}
+	return append(dst, 0x00, 0x01)
+}
+
+// A number is encoded as its float64 value, followed by what an int64 loses
+// when converted to float64. So big integers keep their exact order, and
+// integers and floats compare as numbers.
+func appendFloat(dst []byte, f float64) ([]byte, error) {
+	if math.IsNaN(f) {
+		return nil, fmt.Errorf("%w: NaN", ErrUnsupported)
+	}
+	return appendNumber(dst, f, 0), nil
+}
+
+func appendInt(dst []byte, n int64) []byte {
+	f := float64(n)
+	var rem int64
+	if f >= math.MaxInt64 {
+		// f is 2^63, which is not an int64
+		rem = n - math.MaxInt64 - 1
+	} else {
+		rem = n - int64(f)
+	}
+	return appendNumber(dst, f, rem)
+}
+
+func appendNumber(dst []byte, f float64, rem int64) []byte {
+	if f == 0 {
+		f = 0 // no negative zero
+	}
+	bits := math.Float64bits(f)
+	if bits>>63 == 1 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[:8], bits)
+	binary.BigEndian.PutUint64(buf[8:], uint64(rem)^(1<<63))
+	return append(append(dst, tagNumber), buf[:]...)
+}
+
+//-----------------------------------------------------------------------------
+
+// Decode decodes an encoded tuple, like Res.Index of a query, back into its
+// values. Types are normalized: whole numbers that fit come back as int64,
+// other numbers as float64, strings and []byte as string, times as time.Time
+// in UTC, arrays as []interface{} and objects as map[string]interface{}.
+func Decode(k []byte) (resvals []interface{}, reserr error) {
+	for len(k) > 0 {
+		var v interface{}
+		v, k, reserr = decodeValue(k)
+		if reserr != nil {
+			return nil, reserr
+		}
+		resvals = append(resvals, v)
+	}
+	return
+}
+
+func decodeValue(k []byte) (interface{}, []byte, error) {
+	if len(k) == 0 {
+		return nil, nil, ErrInvalid
+	}
+	tag, k := k[0], k[1:]
+	switch tag {
+	case tagNull:
+		return nil, k, nil
+	case tagFalse:
+		return false, k, nil
+	case tagTrue:
+		return true, k, nil
+	case tagNumber:
+		if len(k) < 16 {
+			return nil, nil, ErrInvalid
+		}
+		return decodeNumber(k[:16]), k[16:], nil
+	case tagString:
+		return decodeString(k)
+	case tagTime:
+		if len(k) < 12 {
+			return nil, nil, ErrInvalid
+		}
+		sec := int64(binary.BigEndian.Uint64(k[:8]) ^ (1 << 63))
+		nsec := int64(binary.BigEndian.Uint32(k[8:12]))
+		return time.Unix(sec, nsec).UTC(), k[12:], nil
+	case tagArray:
+		arr := []interface{}{}
+		for {
+			if len(k) == 0 {
+				return nil, nil, ErrInvalid
+			}
+			if k[0] == tagEnd {
+				return arr, k[1:], nil
+			}
+			var elem interface{}
+			var err error
+			if elem, k, err = decodeValue(k); err != nil {
+				return nil, nil, err
+			}
+			arr = append(arr, elem)
+		}
+	case tagObject:
+		obj := map[string]interface{}{}
+		for {
+			if len(k) == 0 {
+				return nil, nil, ErrInvalid
+			}
+			if k[0] == tagEnd {
+				return obj, k[1:], nil
+			}
+			if k[0] != tagString {
+				return nil, nil, ErrInvalid
+			}
+			var name, val interface{}
+			var err error
+			if name, k, err = decodeString(k[1:]); err != nil {
+				return nil, nil, err
+			}
+			if val, k, err = decodeValue(k); err != nil {
+				return nil, nil, err
+			}
+			obj[name.(string)] = val
+		}
+	}
+	return nil, nil, ErrInvalid
+}
+
+func decodeString(k []byte) (interface{}, []byte, error) {
+	var buf []byte
+	for i := 0; i < len(k); i++ {
+		if k[i] != 0x00 {
+			buf = append(buf, k[i])
+			continue
+		}
+		if i+1 >= len(k) {
+			break
+		}
+		switch k[i+1] {
+		case 0x01:
+			return string(buf), k[i+2:], nil
+		case 0xff:
+			buf = append(buf, 0x00)
+			i++
+			continue
+		}
+		break
+	}
+	return nil, nil, ErrInvalid
+}
+
+func decodeNumber(k []byte) interface{} {
+	bits := binary.BigEndian.Uint64(k[:8])
+	if bits>>63 == 1 {
+		bits &^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	f := math.Float64frombits(bits)
+	rem := int64(binary.BigEndian.Uint64(k[8:]) ^ (1 << 63))
+	if f != math.Trunc(f) || f < math.MinInt64 || f > math.MaxInt64 {
+		return f
+	}
+	if f == math.MaxInt64 {
+		// f is 2^63
+		if rem == 0 {
+			return f
+		}
+		return rem + math.MaxInt64 + 1
+	}
+	return int64(f) + rem
+}
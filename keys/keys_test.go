@@ -0,0 +1,121 @@
+package keys
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOrder(t *testing.T) {
+	require := require.New(t)
+
+	at := time.Date(2018, 5, 20, 0, 0, 0, 0, time.UTC)
+	ordered := [][]interface{}{
+		{nil},
+		{false},
+		{true},
+		{math.Inf(-1)},
+		{-1e300},
+		{int64(math.MinInt64)},
+		{int64(-1 << 62)},
+		{-1.5},
+		{-1},
+		{0},
+		{0.5},
+		{1},
+		{1, nil},
+		{1, "a"},
+		{json.Number("1.5")},
+		{int64(1<<53 + 1)},
+		{int64(1<<53 + 2)},
+		{int64(math.MaxInt64)},
+		{1e300},
+		{""},
+		{"^"},
+		{"a"},
+		{"a\x00"},
+		{"ab"},
+		{at.Add(-time.Hour * 24 * 365 * 60)},
+		{at},
+		{at.Add(time.Nanosecond)},
+		{[]interface{}{}},
+		{[]int{2}},
+		{[]string{"a"}},
+		{[]interface{}{"a", nil}},
+		{[]string{"b"}},
+		{map[string]interface{}{"a": 1}},
+	}
+	var prev []byte
+	for i, v := range ordered {
+		k, err := Encode(v...)
+		require.NoError(err)
+		if i > 0 {
+			require.True(bytes.Compare(prev, k) < 0, "%v < %v", ordered[i-1], v)
+		}
+		prev = k
+	}
+
+	k1, _ := Encode(json.Number("1000"))
+	k2, _ := Encode(1e3)
+	k3, _ := Encode(uint16(1000))
+	require.Equal(k1, k2)
+	require.Equal(k1, k3)
+}
+
+func TestDecode(t *testing.T) {
+	require := require.New(t)
+
+	at := time.Date(2018, 5, 20, 10, 11, 12, 13, time.UTC)
+	k, err := Encode(nil, true, -42, int64(math.MaxInt64), int64(math.MinInt64), 1.5,
+		"a\x00b", []byte("raw"), at, []string{"x", "y"},
+		map[string]interface{}{"n": 1, "s": []interface{}{}})
+	require.NoError(err)
+
+	vals, err := Decode(k)
+	require.NoError(err)
+	require.Equal([]interface{}{nil, true, int64(-42), int64(math.MaxInt64), int64(math.MinInt64), 1.5,
+		"a\x00b", "raw", at, []interface{}{"x", "y"},
+		map[string]interface{}{"n": int64(1), "s": []interface{}{}}}, vals)
+
+	vals, err = Decode(MustEncode(math.Pow(2, 63), 1e300))
+	require.NoError(err)
+	require.Equal([]interface{}{math.Pow(2, 63), 1e300}, vals)
+
+	_, err = Decode(k[:len(k)-1])
+	require.Equal(ErrInvalid, err)
+}
+
+func TestPrefix(t *testing.T) {
+	require := require.New(t)
+
+	pfx, err := Prefix("Frodo", "go")
+	require.NoError(err)
+	for _, s := range []string{"go", "golang", "gozoo"} {
+		require.True(bytes.HasPrefix(MustEncode("Frodo", s), pfx))
+	}
+	require.False(bytes.HasPrefix(MustEncode("Frodo", "g"), pfx))
+	require.False(bytes.HasPrefix(MustEncode("Sam", "go"), pfx))
+
+	pfx, err = Prefix([]string{"a"})
+	require.NoError(err)
+	require.True(bytes.HasPrefix(MustEncode([]string{"a", "b"}), pfx))
+
+	pfx, err = Prefix(1)
+	require.NoError(err)
+	require.Equal(MustEncode(1), pfx)
+}
+
+func TestUnsupported(t *testing.T) {
+	require := require.New(t)
+
+	_, err := Encode(struct{}{})
+	require.Error(err)
+	_, err = Encode(math.NaN())
+	require.Error(err)
+	_, err = Encode(uint64(math.MaxUint64))
+	require.Error(err)
+}
@@ -0,0 +1,264 @@
+package dockage
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+
+// Observer receives the telemetry of a database, see Options.Observer. Its
+// methods are called from many goroutines, and must be fast.
+type Observer interface {
+	// OpDone is called when an operation ends, like "put", "get",
+	// "get_many", "delete" or "query".
+	OpDone(op string, elapsed time.Duration, err error)
+	// Conflict is called when an operation fails, because of the rev of
+	// a document.
+	Conflict(op string)
+	// ViewBuilt is called when a view is built for a document.
+	ViewBuilt(view string, elapsed time.Duration)
+	// TxnSplit is called when a transaction of an operation, like "import"
+	// or "rebuild_view", is too big and is split in smaller ones. It does
+	// not report write contention: conflicts with other transactions are
+	// returned to the caller, as badger.ErrConflict.
+	TxnSplit(op string)
+	// GCRun is called when a value log garbage collection ends.
+	GCRun(elapsed time.Duration, err error)
+	// StartSpan is called when a transaction of an operation starts; end is
+	// called when it is committed or discarded.
+	StartSpan(op string, update bool) (end func(err error))
+}
+
+type nopObserver struct{}
+
+func (nopObserver) OpDone(string, time.Duration, error) {}
+func (nopObserver) Conflict(string)                     {}
+func (nopObserver) ViewBuilt(string, time.Duration)     {}
+func (nopObserver) TxnSplit(string)                     {}
+func (nopObserver) GCRun(time.Duration, error)          {}
+func (nopObserver) StartSpan(string, bool) func(error)  { return nopEnd }
+
+func nopEnd(error) {}
+
+//-----------------------------------------------------------------------------
+
+// Metrics is an Observer, that keeps counts and latency histograms. It can be
+// published as an expvar variable, and served in the Prometheus text format.
+type Metrics struct {
+	mu        sync.Mutex
+	ops       map[string]*histogram
+	opErrors  map[string]uint64
+	conflicts map[string]uint64
+	views     map[string]*histogram
+	txns      map[string]*histogram
+	splits    map[string]uint64
+	gc        histogram
+	gcErrors  uint64
+}
+
+// NewMetrics creates a Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		ops:       make(map[string]*histogram),
+		opErrors:  make(map[string]uint64),
+		conflicts: make(map[string]uint64),
+		views:     make(map[string]*histogram),
+		txns:      make(map[string]*histogram),
+		splits:    make(map[string]uint64),
+	}
+}
+
+// latencyBuckets are the upper bounds, in seconds, of histogram buckets.
+var latencyBuckets = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5}
+
+type histogram struct {
+	counts []uint64 // per bucket, and the last one for +Inf
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets)+1)
+	}
+	s := d.Seconds()
+	i := sort.SearchFloat64s(latencyBuckets, s)
+	h.counts[i]++
+	h.sum += s
+	h.count++
+}
+
+func observeIn(m map[string]*histogram, key string, d time.Duration) {
+	h, ok := m[key]
+	if !ok {
+		h = new(histogram)
+		m[key] = h
+	}
+	h.observe(d)
+}
+
+// OpDone implements Observer.
+func (m *Metrics) OpDone(op string, elapsed time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	observeIn(m.ops, op, elapsed)
+	if err != nil {
+		m.opErrors[op]++
+	}
+}
+
+// Conflict implements Observer.
+func (m *Metrics) Conflict(op string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.conflicts[op]++
+}
+
+// ViewBuilt implements Observer.
+func (m *Metrics) ViewBuilt(view string, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	observeIn(m.views, view, elapsed)
+}
+
+// TxnSplit implements Observer.
+func (m *Metrics) TxnSplit(op string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.splits[op]++
+}
+
+// GCRun implements Observer.
+func (m *Metrics) GCRun(elapsed time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gc.observe(elapsed)
+	if err != nil {
+		m.gcErrors++
+	}
+}
+
+// StartSpan implements Observer; it keeps the durations of transactions.
+func (m *Metrics) StartSpan(op string, update bool) func(err error) {
+	start := time.Now()
+	return func(error) {
+		elapsed := time.Since(start)
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		observeIn(m.txns, op, elapsed)
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+// Publish publishes the metrics as an expvar variable. Like expvar.Publish,
+// it panics if the name is already in use.
+func (m *Metrics) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} { return m.snapshot() }))
+}
+
+func (m *Metrics) snapshot() map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	summary := func(hs map[string]*histogram) map[string]interface{} {
+		res := make(map[string]interface{}, len(hs))
+		for k, h := range hs {
+			res[k] = map[string]interface{}{"count": h.count, "seconds": h.sum}
+		}
+		return res
+	}
+	counts := func(cs map[string]uint64) map[string]uint64 {
+		res := make(map[string]uint64, len(cs))
+		for k, v := range cs {
+			res[k] = v
+		}
+		return res
+	}
+	return map[string]interface{}{
+		"ops":          summary(m.ops),
+		"op_errors":    counts(m.opErrors),
+		"conflicts":    counts(m.conflicts),
+		"views":        summary(m.views),
+		"transactions": summary(m.txns),
+		"txn_splits":   counts(m.splits),
+		"gc":           map[string]interface{}{"count": m.gc.count, "seconds": m.gc.sum, "errors": m.gcErrors},
+	}
+}
+
+// WritePrometheus writes the metrics in the Prometheus text format.
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	m.mu.Lock()
+	writeHistograms(bw, "dockage_op_duration_seconds", "Duration of operations.", "op", m.ops)
+	writeCounters(bw, "dockage_op_errors_total", "Operations that failed.", "op", m.opErrors)
+	writeCounters(bw, "dockage_rev_conflicts_total", "Operations that failed because of a rev conflict.", "op", m.conflicts)
+	writeHistograms(bw, "dockage_view_build_duration_seconds", "Duration of building a view for a document.", "view", m.views)
+	writeHistograms(bw, "dockage_txn_duration_seconds", "Duration of transactions.", "op", m.txns)
+	writeCounters(bw, "dockage_txn_splits_total", "Transactions split after being too big.", "op", m.splits)
+	writeHistograms(bw, "dockage_gc_duration_seconds", "Duration of value log garbage collections.", "", map[string]*histogram{"": &m.gc})
+	writeCounters(bw, "dockage_gc_errors_total", "Value log garbage collections that failed, or had nothing to do.", "", map[string]uint64{"": m.gcErrors})
+	m.mu.Unlock()
+	return bw.Flush()
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WritePrometheus(w)
+}
+
+func labels(label, value string, extra ...string) string {
+	var parts []string
+	if label != "" {
+		parts = append(parts, fmt.Sprintf("%s=%q", label, value))
+	}
+	parts = append(parts, extra...)
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func writeCounters(w io.Writer, name, help, label string, cs map[string]uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	keys := make([]string, 0, len(cs))
+	for k := range cs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %d\n", name, labels(label, k), cs[k])
+	}
+}
+
+func writeHistograms(w io.Writer, name, help, label string, hs map[string]*histogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	keys := make([]string, 0, len(hs))
+	for k := range hs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h := hs[k]
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			if h.counts != nil {
+				cumulative += h.counts[i]
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, labels(label, k, fmt.Sprintf("le=\"%g\"", le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, labels(label, k, `le="+Inf"`), h.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", name, labels(label, k), h.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", name, labels(label, k), h.count)
+	}
+}
+
+//-----------------------------------------------------------------------------
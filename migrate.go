@@ -0,0 +1,191 @@
+package dockage
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/dgraph-io/badger"
+)
+
+//-----------------------------------------------------------------------------
+
+// currentKeyFormat is the version of the on-disk key layout.
+//
+// 1: ^NAME<^VIEW-KEY^ID and ^NAME>^ID^VIEW-KEY, splitted on viewsp, so ids
+// could not contain viewsp and view keys containing it were misread; views
+// namespaced by the hash of their name.
+// 2: escaped segments, see appendSegment; views namespaced by their id in
+// the view catalog.
+const currentKeyFormat = "2"
+
+// legacy domains of key format 1
+const (
+	legacyk2x = ">"
+	legacyx2k = "<"
+)
+
+// migrateKeys converts view keys of older formats to the current one. It
+// runs in as many transactions as needed. The format is only set after
+// the migration is done, and it leaves the keys it has already converted
+// alone, so an interrupted migration continues on next Open.
+func migrateKeys(bdb *badger.DB) (reserr error) {
+	formatKey := []byte(pat4Sys(keyformat))
+	format, reserr := keyFormat(bdb)
+	if reserr != nil || string(format) == currentKeyFormat {
+		return
+	}
+	if len(format) != 0 {
+		return fmt.Errorf("unknown key format %q", format)
+	}
+	reserr = migrateKeys1(bdb, formatKey)
+	return
+}
+
+// keyFormat returns the stored key format, empty for the first one.
+func keyFormat(bdb *badger.DB) (resformat []byte, reserr error) {
+	reserr = bdb.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(pat4Sys(keyformat)))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		resformat, err = item.ValueCopy(nil)
+		return err
+	})
+	return
+}
+
+// migrateKeys1 converts keys of format 1 to format 2. A database without
+// a format is either empty or of format 1. The names of views are not known,
+// only their hashes, so each view gets an id in the catalog under
+// a placeholder name, see unnamedView; the internal sequence view goes to
+// its own namespace.
+func migrateKeys1(bdb *badger.DB, formatKey []byte) (reserr error) {
+	var (
+		catalog []kvop
+		ops     []kvop
+	)
+	reserr = bdb.View(func(txn *badger.Txn) error {
+		next, err := nextNSID(txn)
+		if err != nil {
+			return err
+		}
+		seqHash := string(fnvhash([]byte(viewdbseq)))
+		namespaces := map[string]string{seqHash: sqNS}
+		nsOf := func(hash string) (string, error) {
+			if ns, ok := namespaces[hash]; ok {
+				return ns, nil
+			}
+			// from an interrupted migration
+			ns, found, err := lookupNS(txn, unnamedView(hash))
+			if err != nil {
+				return "", err
+			}
+			if !found {
+				ns = encodeNS(next)
+				next++
+				catalog = append(catalog, kvop{key: catalogKey(unnamedView(hash)), val: []byte(ns)})
+			}
+			namespaces[hash] = ns
+			return ns, nil
+		}
+
+		opt := badger.DefaultIteratorOptions
+		prefix := []byte(viewsp)
+		err = itrFunc(txn, opt, prefix, prefix, func(itr interface{ Item() *badger.Item }) error {
+			item := itr.Item()
+			k := item.KeyCopy(nil)
+			header := len(viewsp) + fnvsize + len(legacyx2k) + len(viewsp)
+			if len(k) < header || !bytes.HasSuffix(k[:header], []byte(viewsp)) {
+				return nil
+			}
+			hash := string(k[len(viewsp) : len(viewsp)+fnvsize])
+			rest := k[header:]
+			switch string(k[header-len(viewsp)-len(legacyx2k) : header-len(viewsp)]) {
+			case legacyx2k:
+				ix := bytes.LastIndex(rest, []byte(viewsp))
+				if ix < 0 {
+					return nil
+				}
+				viewKey, id := rest[:ix], rest[ix+len(viewsp):]
+				v, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				ns, err := nsOf(hash)
+				if err != nil {
+					return err
+				}
+				x2k := append(appendSegment([]byte(pat4View(ns+viewx2k)), viewKey), id...)
+				k2x := append(k2xPrefix(ns, string(id)), viewKey...)
+				ops = append(ops,
+					kvop{key: x2k, val: v},
+					kvop{key: k2x, val: x2k},
+					kvop{key: k, del: true})
+			case legacyk2x:
+				ops = append(ops, kvop{key: k, del: true})
+			}
+			return nil
+		})
+		if err != nil || len(catalog) == 0 {
+			return err
+		}
+		catalog = append(catalog, kvop{key: []byte(pat4Sys(catalognext)), val: []byte(encodeNS(next))})
+		return nil
+	})
+	if reserr != nil {
+		return
+	}
+	// the catalog goes first, so a migration that is interrupted finds
+	// the namespaces it has assigned
+	ops = append(catalog, ops...)
+	ops = append(ops, kvop{key: formatKey, val: []byte(currentKeyFormat)})
+	reserr = applyOps(bdb, ops)
+	return
+}
+
+//-----------------------------------------------------------------------------
+
+type kvop struct {
+	key, val []byte
+	del      bool
+}
+
+// applyOps applies ops in order, committing whenever a transaction gets
+// too big. So it is not atomic, but each op is applied after the ones
+// before it.
+func applyOps(bdb *badger.DB, ops []kvop) error {
+	for len(ops) > 0 {
+		var n int
+		err := bdb.Update(func(txn *badger.Txn) error {
+			for n < len(ops) {
+				var err error
+				if ops[n].del {
+					err = txn.Delete(ops[n].key)
+				} else {
+					err = txn.Set(ops[n].key, ops[n].val)
+				}
+				if err == badger.ErrTxnTooBig {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				n++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return badger.ErrTxnTooBig
+		}
+		ops = ops[n:]
+	}
+	return nil
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,331 @@
+package dockage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/dgraph-io/badger"
+)
+
+//-----------------------------------------------------------------------------
+
+// ExportLine is one line of an export, a document with its id and rev.
+type ExportLine struct {
+	ID  string `json:"id"`
+	Rev string `json:"rev"`
+	// Type is the type (or collection) of the document, if known.
+	Type string          `json:"type,omitempty"`
+	Doc  json.RawMessage `json:"doc"`
+}
+
+// ExportFilter selects the documents to export. The zero value exports all.
+type ExportFilter struct {
+	// Prefix of the ids of documents.
+	Prefix string
+	// Match, if set, is called with the stored json of each document.
+	Match func(id string, doc json.RawMessage) bool
+	// Type, if set, gives the type of each document, to be written to the
+	// line; it is used by Import(...) to recreate typed documents.
+	Type func(id string, doc json.RawMessage) string
+}
+
+// Export writes documents as NDJSON, one ExportLine per line, sorted by id,
+// from one read transaction.
+func (db *DB) Export(w io.Writer, filter ExportFilter) (rescount int, reserr error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	reserr = db.view("export", func(txn *badger.Txn) error {
+		prefix := []byte(pat4Key(filter.Prefix))
+		opt := badger.DefaultIteratorOptions
+		return itrFunc(txn, opt, prefix, prefix, func(itr interface{ Item() *badger.Item }) error {
+			item := itr.Item()
+			id := string(item.Key()[len(keysp):])
+			js, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if filter.Match != nil && !filter.Match(id, js) {
+				return nil
+			}
+			rev, err := db.currentRev(txn, id)
+			if err != nil {
+				return err
+			}
+			line := ExportLine{ID: id, Rev: string(rev), Doc: js}
+			if filter.Type != nil {
+				line.Type = filter.Type(id, js)
+			}
+			rescount++
+			return enc.Encode(line)
+		})
+	})
+	if reserr != nil {
+		return
+	}
+	reserr = bw.Flush()
+	return
+}
+
+//-----------------------------------------------------------------------------
+
+// RevMode tells Import(...) what to do with the revs of documents.
+type RevMode int
+
+// Rev modes
+const (
+	// RevKeep stores documents with the rev of the line, replacing
+	// existing ones. The sequence of revs is moved past kept revs, so new
+	// revs do not repeat them.
+	RevKeep RevMode = iota
+	// RevRegenerate stores documents with a new rev, replacing existing ones.
+	RevRegenerate
+	// RevSkipExisting stores only documents that do not exist, with the rev
+	// of the line.
+	RevSkipExisting
+)
+
+// ImportOptions are options for Import(...).
+type ImportOptions struct {
+	Revs RevMode
+	// BatchSize is the number of documents written in one transaction,
+	// default 100.
+	BatchSize int
+	// New, if set, returns a pointer to a new document of a type, for
+	// the type of a line. The document is decoded into it and passed to
+	// views, like it was passed to Put(...). Documents without a type, or
+	// if New returns nil, are passed to views as json.RawMessage; their rev
+	// is written to their "rev" json field.
+	New func(typ string) interface{}
+}
+
+// Import reads NDJSON, as written by Export(...), and stores the documents
+// in batches, building all views. It returns the number of stored and
+// skipped documents. Empty lines are ignored.
+func (db *DB) Import(r io.Reader, opt ImportOptions) (resimported, resskipped int, reserr error) {
+	if db.sq == nil {
+		reserr = ErrReadOnly
+		return
+	}
+	if opt.BatchSize <= 0 {
+		opt.BatchSize = 100
+	}
+	br := bufio.NewReader(r)
+	var batch []ExportLine
+	for n := 1; ; n++ {
+		data, err := br.ReadBytes('\n')
+		if len(bytes.TrimSpace(data)) > 0 {
+			var line ExportLine
+			if jerr := json.Unmarshal(data, &line); jerr != nil || line.ID == "" || len(line.Doc) == 0 {
+				if jerr == nil {
+					jerr = ErrNoID
+				}
+				reserr = fmt.Errorf("%w: line %d: %v", ErrInvalidImport, n, jerr)
+				return
+			}
+			batch = append(batch, line)
+		}
+		if len(batch) > 0 && (len(batch) == opt.BatchSize || err == io.EOF) {
+			if opt.Revs != RevRegenerate {
+				if aerr := db.advanceRev(batch); aerr != nil {
+					reserr = aerr
+					return
+				}
+			}
+			imported, skipped, ierr := db.importBatch(batch, opt)
+			resimported += imported
+			resskipped += skipped
+			if ierr != nil {
+				reserr = ierr
+				return
+			}
+			batch = batch[:0]
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			reserr = err
+			return
+		}
+	}
+}
+
+// advanceRev moves the sequence of revs past the revs of a batch. The
+// sequence is released, its key is set to the rev after the largest one, if
+// it is behind, and then it is leased again.
+func (db *DB) advanceRev(batch []ExportLine) error {
+	if db.sq == nil {
+		return ErrReadOnly
+	}
+	var max uint64
+	for _, line := range batch {
+		b, err := hex.DecodeString(line.Rev)
+		if err != nil || len(b) != 8 {
+			continue
+		}
+		if sq := binary.BigEndian.Uint64(b); sq > max {
+			max = sq
+		}
+	}
+	db.sqMu.Lock()
+	defer db.sqMu.Unlock()
+	if err := db.sq.Release(); err != nil {
+		return err
+	}
+	key := []byte(pat4Sys(dbseq))
+	err := db.db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		v, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if len(v) == 8 && binary.BigEndian.Uint64(v) > max {
+			return nil
+		}
+		next := make([]byte, 8)
+		binary.BigEndian.PutUint64(next, max+1)
+		return txn.Set(key, next)
+	})
+	if err != nil {
+		return err
+	}
+	sq, err := db.db.GetSequence(key, revBandwidth)
+	if err != nil {
+		return err
+	}
+	db.sq = sq
+	return nil
+}
+
+// importBatch stores a batch in one transaction, splitting it if it does not
+// fit in one.
+func (db *DB) importBatch(batch []ExportLine, opt ImportOptions) (resimported, resskipped int, reserr error) {
+	reserr = db.update("import", func(txn *badger.Txn) error {
+		resimported, resskipped = 0, 0
+		tx := newTransaction(context.Background(), txn, db.obs)
+		for _, line := range batch {
+			stored, err := db.importLine(tx, line, opt)
+			if err != nil {
+				return err
+			}
+			if stored {
+				resimported++
+			} else {
+				resskipped++
+			}
+		}
+		return db.writeCounts(tx)
+	})
+	if reserr == badger.ErrTxnTooBig && len(batch) > 1 {
+		db.obs.TxnSplit("import")
+		half := len(batch) / 2
+		i1, s1, err := db.importBatch(batch[:half], opt)
+		if err != nil {
+			return i1, s1, err
+		}
+		i2, s2, err := db.importBatch(batch[half:], opt)
+		return i1 + i2, s1 + s2, err
+	}
+	if reserr != nil {
+		resimported, resskipped = 0, 0
+	}
+	return
+}
+
+func (db *DB) importLine(tx *transaction, line ExportLine, opt ImportOptions) (resstored bool, reserr error) {
+	current, err := db.currentRev(tx.tx, line.ID)
+	if err != nil {
+		return false, err
+	}
+	if current != nil && opt.Revs == RevSkipExisting {
+		return false, nil
+	}
+	if current == nil {
+		if err := clearTombstone(tx.tx, line.ID); err != nil {
+			return false, err
+		}
+	}
+	rev := line.Rev
+	if rev == "" || opt.Revs == RevRegenerate {
+		next, err := db.nextRev()
+		if err != nil {
+			return false, err
+		}
+		rev = string(next)
+	}
+
+	var doc interface{}
+	if opt.New != nil && line.Type != "" {
+		doc = opt.New(line.Type)
+	}
+	var js []byte
+	if doc != nil {
+		if err := json.Unmarshal(line.Doc, doc); err != nil {
+			return false, fmt.Errorf("%w: %s: %v", ErrInvalidImport, line.ID, err)
+		}
+		id, frev, err := prepdoc(doc, nil)
+		if err != nil {
+			return false, err
+		}
+		if string(id) != line.ID {
+			return false, fmt.Errorf("%w: id %s of document does not match %s", ErrInvalidImport, id, line.ID)
+		}
+		if err := frev.Set(rev); err != nil {
+			return false, err
+		}
+		if js, err = json.Marshal(doc); err != nil {
+			return false, err
+		}
+	} else {
+		if js, err = setRev(line.Doc, rev); err != nil {
+			return false, fmt.Errorf("%w: %s: %v", ErrInvalidImport, line.ID, err)
+		}
+		doc = json.RawMessage(js)
+	}
+
+	revView := newView(viewdbseq, func(em Emitter, id string, doc interface{}) (interface{}, error) {
+		em.Emit([]byte(rev), nil)
+		return nil, nil
+	})
+	revView.ns = sqNS
+	if _, err := newViewEmitter(tx, revView).build(line.ID, doc); err != nil {
+		return false, err
+	}
+	if err := tx.tx.Set([]byte(pat4Key(line.ID)), js); err != nil {
+		return false, err
+	}
+	if _, err := db.views.buildAll(tx, line.ID, doc, js); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// setRev sets the "rev" field of a json object, if it has one and it is
+// not rev already.
+func setRev(js []byte, rev string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(js, &fields); err != nil {
+		return nil, err
+	}
+	old, ok := fields["rev"]
+	if !ok {
+		return js, nil
+	}
+	var oldRev string
+	if err := json.Unmarshal(old, &oldRev); err == nil && oldRev == rev {
+		return js, nil
+	}
+	fields["rev"], _ = json.Marshal(rev)
+	return json.Marshal(fields)
+}
+
+//-----------------------------------------------------------------------------
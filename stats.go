@@ -0,0 +1,363 @@
+package dockage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+//-----------------------------------------------------------------------------
+
+// Stats describes the size of a database, see Stats().
+type Stats struct {
+	// Docs is the number of documents.
+	Docs int
+	// Views holds the number of entries and the size of the keys of the views
+	// in the catalog, by name.
+	Views map[string]ViewStats
+	// Seq is the last rev given to a document, or to a deletion.
+	Seq string
+	// LSMSize and VlogSize are the sizes, in bytes, of the files of
+	// the storage.
+	LSMSize, VlogSize int64
+	// LastGC is when a value log file was last rewritten by the garbage
+	// collection of this process; zero if never. Runs that found nothing
+	// to rewrite, or failed, are not counted.
+	LastGC time.Time
+}
+
+// ViewStats is the size of a view.
+type ViewStats struct {
+	// Entries is the number of emitted view keys.
+	Entries int
+	// Size is the size, in bytes, of the keys of the entries; emitted
+	// values are not counted.
+	Size int64
+}
+
+// Stats returns the number of documents and the size of views, from
+// counters kept while documents are put and deleted, without scanning them.
+func (db *DB) Stats() (resstats Stats, reserr error) {
+	if db.statsSq != nil {
+		if reserr = db.foldCounts(); reserr != nil {
+			return
+		}
+	}
+	resstats.Views = make(map[string]ViewStats)
+	reserr = db.view("stats", func(txn *badger.Txn) error {
+		counts, _, err := readCounts(txn, 0)
+		if err != nil {
+			return err
+		}
+		resstats.Docs = int(counts[sqNS].entries)
+
+		opt := badger.DefaultIteratorOptions
+		prefix := catalogKey("")
+		err = itrFunc(txn, opt, prefix, prefix, func(itr interface{ Item() *badger.Item }) error {
+			ns, err := itr.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			c := counts[string(ns)]
+			name := string(bytes.TrimPrefix(itr.Item().Key(), prefix))
+			resstats.Views[name] = ViewStats{Entries: int(c.entries), Size: c.size}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// the highest rev of a document
+		opt.PrefetchValues = false
+		opt.Reverse = true
+		itr := txn.NewIterator(opt)
+		defer itr.Close()
+		prefix = []byte(pat4View(sqNS + viewx2k))
+		itr.Seek(append(prefix[:len(prefix):len(prefix)], 0xff))
+		if itr.ValidForPrefix(prefix) {
+			rev, _ := splitViewKey(itr.Item().Key())
+			resstats.Seq = string(rev)
+		}
+		return nil
+	})
+	if reserr != nil {
+		return
+	}
+	if last := atomic.LoadUint64(&db.lastSeq); last > 0 {
+		ix := make([]byte, 8)
+		binary.BigEndian.PutUint64(ix, last)
+		if rev := hex.EncodeToString(ix); rev > resstats.Seq {
+			resstats.Seq = rev
+		}
+	}
+	resstats.LSMSize, resstats.VlogSize = db.db.Size()
+	if at := atomic.LoadInt64(&db.gcAt); at > 0 {
+		resstats.LastGC = time.Unix(0, at)
+	}
+	return
+}
+
+//-----------------------------------------------------------------------------
+
+// The number of entries and the size of each view are counted while views
+// are built. Writers do not read counters, so they do not conflict: each
+// write transaction adds a record of its changes, that are folded into
+// the counters later.
+//
+//	.stats.NS        -> entries, size (varints)
+//	.stats_delta.SEQ -> NS, entries, size (varints), for each changed view
+//	.stats_seq       -> sequence of delta records
+//
+// The internal sequence view has an entry for each document, so its entries
+// are the number of documents.
+const (
+	statsBase  = "stats"
+	statsDelta = "stats_delta"
+	statsSeq   = "stats_seq"
+
+	foldBatch = 1000
+	foldAfter = 1000 // delta records written before folding them
+)
+
+type viewCount struct{ entries, size int64 }
+
+// count adds changes to the counters of view ns, to be written by
+// writeCounts(...).
+func (tx *transaction) count(ns string, entries, size int64) {
+	if tx.counts == nil {
+		tx.counts = make(map[string]viewCount)
+	}
+	c := tx.counts[ns]
+	tx.counts[ns] = viewCount{c.entries + entries, c.size + size}
+}
+
+// entrySize is the size of the keys of an entry of a view: the k2x key, with
+// the x2k key as its value, and the x2k key. Emitted values are left out, so
+// deleting an entry does not read its value.
+func entrySize(k2x, x2k []byte) int64 {
+	return int64(len(k2x) + 2*len(x2k))
+}
+
+// writeCounts writes the changes to counters made in tx, as a delta record,
+// and the changes to the stats of text views, as delta records of each view.
+func (db *DB) writeCounts(tx *transaction) error {
+	var rec []byte
+	for ns, c := range tx.counts {
+		if c.entries == 0 && c.size == 0 {
+			continue
+		}
+		rec = append(rec, ns...)
+		rec = appendVarint(rec, c.entries)
+		rec = appendVarint(rec, c.size)
+	}
+	texts := tx.texts
+	tx.counts, tx.texts = nil, nil
+	if len(rec) == 0 && len(texts) == 0 {
+		return nil
+	}
+	if db.statsSq == nil {
+		return ErrReadOnly
+	}
+	sq, err := db.statsSq.Next()
+	if err != nil {
+		return err
+	}
+	if sq%foldAfter == foldAfter-1 {
+		db.foldLater()
+	}
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, sq)
+	for ns, c := range texts {
+		if err := tx.tx.Set(append(textStatsKey(ns), k...), encodeCount(c)); err != nil {
+			return err
+		}
+	}
+	if len(rec) == 0 {
+		return nil
+	}
+	return tx.tx.Set(append([]byte(pat4Sys(statsDelta, "")), k...), rec)
+}
+
+// foldLater folds the delta records in the background, unless it is already
+// being done, so they do not pile up between runs of the maintenance loop.
+// Close() waits for it.
+func (db *DB) foldLater() {
+	if !atomic.CompareAndSwapInt32(&db.folding, 0, 1) {
+		return
+	}
+	db.foldDone.Add(1)
+	go func() {
+		defer db.foldDone.Done()
+		defer atomic.StoreInt32(&db.folding, 0)
+		db.foldCounts()
+	}()
+}
+
+func baseKey(ns string) []byte { return []byte(pat4Sys(statsBase, ns)) }
+
+func appendVarint(dst []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(dst, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+func encodeCount(c viewCount) []byte {
+	return appendVarint(appendVarint(nil, c.entries), c.size)
+}
+
+// decodeCount decodes a count from the start of rec.
+func decodeCount(rec []byte) (resc viewCount, resrest []byte, ok bool) {
+	entries, n := binary.Varint(rec)
+	if n <= 0 {
+		return
+	}
+	size, m := binary.Varint(rec[n:])
+	if m <= 0 {
+		return
+	}
+	return viewCount{entries, size}, rec[n+m:], true
+}
+
+// readCounts sums the counters and up to max delta records, all if max is
+// 0. It returns the keys of the delta records it has read.
+func readCounts(txn *badger.Txn, max int) (rescounts map[string]viewCount, resdeltas [][]byte, reserr error) {
+	rescounts = make(map[string]viewCount)
+	add := func(ns string, c viewCount) {
+		sum := rescounts[ns]
+		rescounts[ns] = viewCount{sum.entries + c.entries, sum.size + c.size}
+	}
+	opt := badger.DefaultIteratorOptions
+	prefix := []byte(pat4Sys(statsBase, ""))
+	reserr = itrFunc(txn, opt, prefix, prefix, func(itr interface{ Item() *badger.Item }) error {
+		v, err := itr.Item().ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if c, _, ok := decodeCount(v); ok {
+			add(string(bytes.TrimPrefix(itr.Item().Key(), prefix)), c)
+		}
+		return nil
+	})
+	if reserr != nil {
+		return
+	}
+	prefix = []byte(pat4Sys(statsDelta, ""))
+	reserr = itrFunc(txn, opt, prefix, prefix, func(itr interface{ Item() *badger.Item }) error {
+		if max > 0 && len(resdeltas) == max {
+			return errStop
+		}
+		v, err := itr.Item().ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		for len(v) > nssize {
+			ns := string(v[:nssize])
+			c, rest, ok := decodeCount(v[nssize:])
+			if !ok {
+				break
+			}
+			add(ns, c)
+			v = rest
+		}
+		resdeltas = append(resdeltas, itr.Item().KeyCopy(nil))
+		return nil
+	})
+	return
+}
+
+// foldCounts adds the delta records to the counters, and deletes them; also
+// the ones of text views.
+func (db *DB) foldCounts() error {
+	db.statsMu.Lock()
+	defer db.statsMu.Unlock()
+	for _, v := range db.views {
+		if !v.text {
+			continue
+		}
+		if err := db.foldTextStats(v.ns); err != nil {
+			return err
+		}
+	}
+	for done := false; !done; {
+		err := db.update("fold_counts", func(txn *badger.Txn) error {
+			counts, deltas, err := readCounts(txn, foldBatch)
+			if err != nil {
+				return err
+			}
+			done = len(deltas) < foldBatch
+			if len(deltas) == 0 {
+				return nil
+			}
+			for ns, c := range counts {
+				if err := txn.Set(baseKey(ns), encodeCount(c)); err != nil {
+					return err
+				}
+			}
+			for _, k := range deltas {
+				if err := txn.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// initCounts counts the entries of view ns, by scanning them, if it has no
+// counter yet; for views that were built before counters were kept.
+func initCounts(bdb *badger.DB, ns string) error {
+	return bdb.Update(func(txn *badger.Txn) error {
+		_, err := txn.Get(baseKey(ns))
+		if err != badger.ErrKeyNotFound {
+			return err
+		}
+		c, err := scanCounts(txn, ns)
+		if err != nil {
+			return err
+		}
+		return txn.Set(baseKey(ns), encodeCount(c))
+	})
+}
+
+// scanCounts counts the entries of view ns, and their size as given by
+// entrySize(...), by scanning its x2k keys.
+func scanCounts(txn *badger.Txn, ns string) (rescount viewCount, reserr error) {
+	opt := badger.DefaultIteratorOptions
+	opt.PrefetchValues = false
+	prefix := []byte(pat4View(ns + viewx2k))
+	reserr = itrFunc(txn, opt, prefix, prefix, func(itr interface{ Item() *badger.Item }) error {
+		x2k := itr.Item().Key()
+		if ns == sqNS {
+			if deleted, err := isTombstone(itr.Item()); err != nil || deleted {
+				return err
+			}
+		}
+		viewKey, id := splitViewKey(x2k)
+		k2x := append(k2xPrefix(ns, string(id)), viewKey...)
+		rescount.entries++
+		rescount.size += entrySize(k2x, x2k)
+		return nil
+	})
+	return
+}
+
+// resetCounts zeroes the counters of view ns, inside tx, for a view whose
+// data is deleted.
+func (db *DB) resetCounts(tx *transaction, ns string) error {
+	counts, _, err := readCounts(tx.tx, 0)
+	if err != nil {
+		return err
+	}
+	c, pending := counts[ns], tx.counts[ns]
+	tx.count(ns, -c.entries-pending.entries, -c.size-pending.size)
+	return nil
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,525 @@
+package dockage
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/dgraph-io/badger"
+)
+
+//-----------------------------------------------------------------------------
+
+// Analyzer turns text into a list of terms, in the order they appear.
+type Analyzer func(text string) []string
+
+// NewAnalyzer creates an Analyzer that splits text on anything that is not
+// a letter or a digit, lowercases and folds Latin letters with diacritics
+// (é to e), drops stopWords and strips common English suffixes (simple
+// stemming: "searching", "searched" and "searches" become "search").
+func NewAnalyzer(stopWords ...string) Analyzer {
+	stop := make(map[string]bool)
+	for _, w := range stopWords {
+		stop[fold(w)] = true
+	}
+	return func(text string) (resterms []string) {
+		words := strings.FieldsFunc(text, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		for _, w := range words {
+			w = fold(w)
+			if stop[w] {
+				continue
+			}
+			resterms = append(resterms, stem(w))
+		}
+		return
+	}
+}
+
+// EnglishStopWords are used by DefaultAnalyzer.
+var EnglishStopWords = []string{
+	"a", "an", "and", "are", "as", "at", "be", "but", "by", "for", "if", "in",
+	"into", "is", "it", "no", "not", "of", "on", "or", "such", "that", "the",
+	"their", "then", "there", "these", "they", "this", "to", "was", "will",
+	"with",
+}
+
+// DefaultAnalyzer is used by text views without an Analyzer.
+var DefaultAnalyzer = NewAnalyzer(EnglishStopWords...)
+
+var foldings = map[rune]string{}
+
+func init() {
+	for to, from := range map[string]string{
+		"a": "àáâãäåāăą", "c": "çćĉċč", "d": "ďđ", "e": "èéêëēĕėęě",
+		"g": "ĝğġģ", "h": "ĥħ", "i": "ìíîïĩīĭįı", "j": "ĵ", "k": "ķ",
+		"l": "ĺļľŀł", "n": "ñńņňŉ", "o": "òóôõöøōŏő", "r": "ŕŗř",
+		"s": "śŝşš", "t": "ţťŧ", "u": "ùúûüũūŭůűų", "w": "ŵ", "y": "ýÿŷ",
+		"z": "źżž", "ss": "ß", "ae": "æ", "oe": "œ", "th": "þ",
+	} {
+		for _, r := range from {
+			foldings[r] = to
+		}
+	}
+}
+
+// fold lowercases w and removes diacritics from Latin letters.
+func fold(w string) string {
+	var sb strings.Builder
+	for _, r := range strings.ToLower(w) {
+		if to, ok := foldings[r]; ok {
+			sb.WriteString(to)
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// stem strips a few common English suffixes.
+func stem(w string) string {
+	switch {
+	case len(w) > 4 && strings.HasSuffix(w, "ies"):
+		return w[:len(w)-3] + "y"
+	case strings.HasSuffix(w, "sses"):
+		return w[:len(w)-2]
+	case len(w) > 5 && strings.HasSuffix(w, "ing"):
+		return undouble(w[:len(w)-3])
+	case len(w) > 4 && strings.HasSuffix(w, "ed"):
+		return undouble(w[:len(w)-2])
+	case len(w) > 4 && strings.HasSuffix(w, "ly"):
+		return w[:len(w)-2]
+	case len(w) > 4 && (strings.HasSuffix(w, "ches") || strings.HasSuffix(w, "shes") ||
+		strings.HasSuffix(w, "xes") || strings.HasSuffix(w, "zes")):
+		return w[:len(w)-2]
+	case len(w) > 3 && strings.HasSuffix(w, "s") &&
+		!strings.HasSuffix(w, "ss") && !strings.HasSuffix(w, "us") && !strings.HasSuffix(w, "is"):
+		return w[:len(w)-1]
+	}
+	return w
+}
+
+// undouble turns a stem like "runn" into "run".
+func undouble(w string) string {
+	n := len(w)
+	if n > 2 && w[n-1] == w[n-2] && !strings.ContainsRune("aeioulsz", rune(w[n-1])) {
+		return w[:n-1]
+	}
+	return w
+}
+
+//-----------------------------------------------------------------------------
+
+// NewTextView creates a View for full text search, using Search(...). The
+// texts returned by fieldsFn are split into terms by analyzer (DefaultAnalyzer
+// if nil). For each term, the view key is the term and the view value holds
+// its positions in the document. The number of terms of the document is kept
+// under the empty view key.
+func NewTextView(name string, fieldsFn func(doc interface{}) []string, analyzer Analyzer) (resview View) {
+	if fieldsFn == nil {
+		panic("fieldsFn must be provided")
+	}
+	if analyzer == nil {
+		analyzer = DefaultAnalyzer
+	}
+	viewFn := func(emitter Emitter, id string, doc interface{}) (inf interface{}, err error) {
+		positions := make(map[string][]int)
+		var order []string
+		pos := 0
+		for _, text := range fieldsFn(doc) {
+			for _, term := range analyzer(text) {
+				if _, ok := positions[term]; !ok {
+					order = append(order, term)
+				}
+				positions[term] = append(positions[term], pos)
+				pos++
+			}
+			// a gap, so phrases do not span fields
+			pos++
+		}
+		if len(order) == 0 {
+			return
+		}
+		var length int
+		for _, term := range order {
+			emitter.Emit([]byte(term), encodePositions(positions[term]))
+			length += len(positions[term])
+		}
+		emitter.Emit([]byte{}, appendUvarint(nil, uint64(length)))
+		return
+	}
+	resview = newView(name, viewFn)
+	resview.text = true
+	resview.analyzer = analyzer
+	return
+}
+
+func appendUvarint(dst []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(dst, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func encodePositions(positions []int) (res []byte) {
+	prev := 0
+	for _, p := range positions {
+		res = appendUvarint(res, uint64(p-prev))
+		prev = p
+	}
+	return
+}
+
+func decodePositions(b []byte) (res []int) {
+	prev := 0
+	for len(b) > 0 {
+		d, n := binary.Uvarint(b)
+		if n <= 0 {
+			return
+		}
+		prev += int(d)
+		res = append(res, prev)
+		b = b[n:]
+	}
+	return
+}
+
+// The number of documents of a text view and their total length are kept
+// like the counters of views: each write transaction adds a delta record, so
+// writers do not conflict, and they are folded by foldCounts().
+//
+//	^NS#      -> docs, length (8 bytes each)
+//	^NS# SEQ  -> docs, length (varints), a delta record
+func textStatsKey(ns string) []byte { return []byte(pat4View(ns + viewsts)) }
+
+// countText adds changes to the stats of text view ns, to be written by
+// writeCounts(...).
+func (tx *transaction) countText(ns string, docs, length int64) {
+	if tx.texts == nil {
+		tx.texts = make(map[string]viewCount)
+	}
+	c := tx.texts[ns]
+	tx.texts[ns] = viewCount{c.entries + docs, c.size + length}
+}
+
+func textStats(txn *badger.Txn, ns string) (docs, length int64, reserr error) {
+	c, _, reserr := readTextStats(txn, ns, 0)
+	return c.entries, c.size, reserr
+}
+
+// readTextStats sums the stats of text view ns and up to max of its delta
+// records, all if max is 0. It returns the keys of the delta records it has
+// read.
+func readTextStats(txn *badger.Txn, ns string, max int) (resc viewCount, resdeltas [][]byte, reserr error) {
+	prefix := textStatsKey(ns)
+	opt := badger.DefaultIteratorOptions
+	reserr = itrFunc(txn, opt, prefix, prefix, func(itr interface{ Item() *badger.Item }) error {
+		item := itr.Item()
+		if max > 0 && len(resdeltas) == max {
+			return errStop
+		}
+		v, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if len(item.Key()) == len(prefix) {
+			if len(v) == 16 {
+				resc.entries += int64(binary.BigEndian.Uint64(v))
+				resc.size += int64(binary.BigEndian.Uint64(v[8:]))
+			}
+			return nil
+		}
+		if c, _, ok := decodeCount(v); ok {
+			resc.entries += c.entries
+			resc.size += c.size
+		}
+		resdeltas = append(resdeltas, item.KeyCopy(nil))
+		return nil
+	})
+	return
+}
+
+// foldTextStats adds the delta records of text view ns to its stats, and
+// deletes them.
+func (db *DB) foldTextStats(ns string) error {
+	for done := false; !done; {
+		err := db.update("fold_counts", func(txn *badger.Txn) error {
+			c, deltas, err := readTextStats(txn, ns, foldBatch)
+			if err != nil {
+				return err
+			}
+			done = len(deltas) < foldBatch
+			if len(deltas) == 0 {
+				return nil
+			}
+			v := make([]byte, 16)
+			binary.BigEndian.PutUint64(v, uint64(c.entries))
+			binary.BigEndian.PutUint64(v[8:], uint64(c.size))
+			if err := txn.Set(textStatsKey(ns), v); err != nil {
+				return err
+			}
+			for _, k := range deltas {
+				if err := txn.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// docLength reads the number of terms of a document, from its x2k key
+// under the empty view key.
+func docLength(txn *badger.Txn, x2k []byte) (int64, error) {
+	item, err := txn.Get(x2k)
+	if err == badger.ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	v, err := item.ValueCopy(nil)
+	if err != nil {
+		return 0, err
+	}
+	dl, _ := binary.Uvarint(v)
+	return int64(dl), nil
+}
+
+//-----------------------------------------------------------------------------
+
+// SearchRes is a document found by Search(...).
+type SearchRes struct {
+	ID    string
+	Score float64
+}
+
+// BM25 parameters used by Search(...).
+const (
+	bm25k1 = 1.2
+	bm25b  = 0.75
+)
+
+// Search finds documents in a text view, ranked by BM25, best first. Terms of
+// query are analyzed like the indexed texts; a document matches if it
+// matches any of them. A term ending in * matches all terms starting with
+// it, and terms inside double quotes match as a phrase.
+func (db *DB) Search(view, query string, limit int) (reslist []SearchRes, reserr error) {
+	vw, ok := db.views.find(view)
+	if !ok || !vw.text {
+		return nil, ErrViewNotFound
+	}
+	if limit <= 0 {
+		limit = 100
+	}
+	reserr = db.view("search", func(txn *badger.Txn) error {
+		docs, length, err := textStats(txn, vw.ns)
+		if err != nil || docs == 0 {
+			return err
+		}
+		s := &searcher{
+			txn:     txn,
+			ns:      vw.ns,
+			docs:    float64(docs),
+			avgdl:   float64(length) / float64(docs),
+			scores:  make(map[string]float64),
+			lengths: make(map[string]float64),
+		}
+		for _, c := range parseTextQuery(query, vw.analyzer) {
+			if err := s.add(c); err != nil {
+				return err
+			}
+		}
+		for id, score := range s.scores {
+			reslist = append(reslist, SearchRes{ID: id, Score: score})
+		}
+		return nil
+	})
+	if reserr != nil {
+		return nil, reserr
+	}
+	sort.Slice(reslist, func(i, j int) bool {
+		if reslist[i].Score != reslist[j].Score {
+			return reslist[i].Score > reslist[j].Score
+		}
+		return reslist[i].ID < reslist[j].ID
+	})
+	if len(reslist) > limit {
+		reslist = reslist[:limit]
+	}
+	return
+}
+
+// textClause is a part of a search query: a term, a prefix or a phrase.
+type textClause struct {
+	terms  []string
+	prefix bool
+}
+
+func parseTextQuery(query string, analyzer Analyzer) (resclauses []textClause) {
+	parts := strings.Split(query, `"`)
+	for i, part := range parts {
+		if i%2 == 1 {
+			if terms := analyzer(part); len(terms) > 0 {
+				resclauses = append(resclauses, textClause{terms: terms})
+			}
+			continue
+		}
+		for _, w := range strings.Fields(part) {
+			if strings.HasSuffix(w, "*") {
+				if terms := analyzer(strings.TrimSuffix(w, "*")); len(terms) > 0 {
+					last := len(terms) - 1
+					for _, t := range terms[:last] {
+						resclauses = append(resclauses, textClause{terms: []string{t}})
+					}
+					resclauses = append(resclauses, textClause{terms: terms[last:], prefix: true})
+				}
+				continue
+			}
+			for _, t := range analyzer(w) {
+				resclauses = append(resclauses, textClause{terms: []string{t}})
+			}
+		}
+	}
+	return
+}
+
+type searcher struct {
+	txn     *badger.Txn
+	ns      string
+	docs    float64
+	avgdl   float64
+	scores  map[string]float64
+	lengths map[string]float64
+}
+
+// postings maps document ids to the positions of a term.
+type postings map[string][]int
+
+func (s *searcher) add(c textClause) error {
+	if c.prefix {
+		all, err := s.prefixPostings(c.terms[0])
+		if err != nil {
+			return err
+		}
+		for _, p := range all {
+			if err := s.score(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var phrase postings
+	for i, term := range c.terms {
+		p, err := s.postings(term)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			phrase = p
+			continue
+		}
+		phrase = followedBy(phrase, p)
+	}
+	return s.score(phrase)
+}
+
+// followedBy keeps the positions of p, that are followed by a position
+// of next; positions are of the last term of p.
+func followedBy(p, next postings) postings {
+	res := make(postings)
+	for id, positions := range p {
+		nextPositions, ok := next[id]
+		if !ok {
+			continue
+		}
+		var kept []int
+		j := 0
+		for _, pos := range positions {
+			for j < len(nextPositions) && nextPositions[j] <= pos {
+				j++
+			}
+			if j < len(nextPositions) && nextPositions[j] == pos+1 {
+				kept = append(kept, pos+1)
+			}
+		}
+		if len(kept) > 0 {
+			res[id] = kept
+		}
+	}
+	return res
+}
+
+func (s *searcher) score(p postings) error {
+	n := float64(len(p))
+	if n == 0 {
+		return nil
+	}
+	idf := math.Log(1 + (s.docs-n+0.5)/(n+0.5))
+	for id, positions := range p {
+		dl, err := s.length(id)
+		if err != nil {
+			return err
+		}
+		tf := float64(len(positions))
+		s.scores[id] += idf * tf * (bm25k1 + 1) / (tf + bm25k1*(1-bm25b+bm25b*dl/s.avgdl))
+	}
+	return nil
+}
+
+func (s *searcher) length(id string) (float64, error) {
+	if dl, ok := s.lengths[id]; ok {
+		return dl, nil
+	}
+	x2k := append(appendSegment([]byte(pat4View(s.ns+viewx2k)), nil), id...)
+	dl, err := docLength(s.txn, x2k)
+	if err != nil {
+		return 0, err
+	}
+	s.lengths[id] = float64(dl)
+	return float64(dl), nil
+}
+
+func (s *searcher) postings(term string) (postings, error) {
+	all, err := s.scan(appendSegment([]byte(pat4View(s.ns+viewx2k)), []byte(term)))
+	if err != nil {
+		return nil, err
+	}
+	return all[term], nil
+}
+
+func (s *searcher) prefixPostings(prefix string) (map[string]postings, error) {
+	return s.scan(appendEscaped([]byte(pat4View(s.ns+viewx2k)), []byte(prefix)))
+}
+
+// scan reads the postings of all terms starting with prefix.
+func (s *searcher) scan(prefix []byte) (map[string]postings, error) {
+	res := make(map[string]postings)
+	opt := badger.DefaultIteratorOptions
+	err := itrFunc(s.txn, opt, prefix, prefix, func(itr interface{ Item() *badger.Item }) error {
+		item := itr.Item()
+		term, id := splitViewKey(item.Key())
+		if len(term) == 0 {
+			return nil
+		}
+		v, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		p, ok := res[string(term)]
+		if !ok {
+			p = make(postings)
+			res[string(term)] = p
+		}
+		p[string(id)] = decodePositions(v)
+		return nil
+	})
+	return res, err
+}
+
+//-----------------------------------------------------------------------------
@@ -1,15 +1,26 @@
 package dockage
 
-import "github.com/dgraph-io/badger"
+import (
+	"context"
+
+	"github.com/dgraph-io/badger"
+)
 
 //-----------------------------------------------------------------------------
 
 type transaction struct {
-	tx *badger.Txn
+	ctx context.Context
+	tx  *badger.Txn
+	// counts are changes to the counters of views, see writeCounts(...)
+	counts map[string]viewCount
+	// texts are changes to the number and total length of documents of
+	// text views, see writeCounts(...)
+	texts map[string]viewCount
+	obs   Observer
 }
 
-func newTransaction(tx *badger.Txn) *transaction {
-	return &transaction{tx: tx}
+func newTransaction(ctx context.Context, tx *badger.Txn, obs Observer) *transaction {
+	return &transaction{ctx: ctx, tx: tx, obs: obs}
 }
 
 //-----------------------------------------------------------------------------
@@ -0,0 +1,758 @@
+package dockage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/dgraph-io/badger"
+)
+
+//-----------------------------------------------------------------------------
+
+// Metric is a distance between vectors.
+type Metric int
+
+// Metrics; smaller distances are nearer.
+const (
+	// Cosine distance is 1 - cosine similarity.
+	Cosine Metric = iota
+	// Dot distance is the negated dot product.
+	Dot
+	// L2 distance is the euclidean distance.
+	L2
+)
+
+func (m Metric) distance(a, b []float32) float64 {
+	var dot, na, nb float64
+	switch m {
+	case L2:
+		for i := range a {
+			d := float64(a[i]) - float64(b[i])
+			dot += d * d
+		}
+		return math.Sqrt(dot)
+	case Dot:
+		for i := range a {
+			dot += float64(a[i]) * float64(b[i])
+		}
+		return -dot
+	}
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 1
+	}
+	return 1 - dot/math.Sqrt(na*nb)
+}
+
+// VectorEmitter is passed to the function of a vector view.
+type VectorEmitter interface {
+	EmitVector(vector []float32)
+}
+
+// VectorFn function that emits the vector of a document.
+type VectorFn func(emitter VectorEmitter, id string, doc interface{})
+
+// VectorIndex configures the approximate index of a vector view, a HNSW
+// (hierarchical navigable small world) graph, built for one Metric.
+type VectorIndex struct {
+	Metric Metric
+	// M is the number of neighbors of a node (twice that on the bottom layer),
+	// default 16.
+	M int
+	// EfConstruction is the number of candidates searched when a node is
+	// added, default 100.
+	EfConstruction int
+	// EfSearch is the number of candidates searched by Nearest(...), default
+	// 50 (at least k).
+	EfSearch int
+}
+
+// vectorKey is the view key of all vectors; the view value is the vector.
+var vectorKey = []byte("v")
+
+// NewVectorView creates a View that stores one vector per document, the last
+// one emitted, to be searched by Nearest(...). All vectors of a view must
+// have the same length. If index is not nil, an approximate index is also
+// kept, and updated inside the Put and Delete transactions.
+func NewVectorView(name string, vectorFn VectorFn, index *VectorIndex) (resview View) {
+	if vectorFn == nil {
+		panic("vectorFn must be provided")
+	}
+	viewFn := func(emitter Emitter, id string, doc interface{}) (inf interface{}, err error) {
+		vem := &vectorEmitter{}
+		vectorFn(vem, id, doc)
+		if vem.err != nil {
+			return nil, vem.err
+		}
+		if vem.vector != nil {
+			emitter.Emit(vectorKey, vem.vector)
+		}
+		return
+	}
+	resview = newView(name, viewFn)
+	resview.vector = true
+	if index != nil {
+		ix := *index
+		if ix.M <= 0 {
+			ix.M = 16
+		}
+		if ix.EfConstruction <= 0 {
+			ix.EfConstruction = 100
+		}
+		if ix.EfSearch <= 0 {
+			ix.EfSearch = 50
+		}
+		resview.vectors = &ix
+	}
+	return
+}
+
+type vectorEmitter struct {
+	vector []byte
+	err    error
+}
+
+func (vem *vectorEmitter) EmitVector(vector []float32) {
+	if len(vector) == 0 {
+		vem.err = fmt.Errorf("%w: empty", ErrInvalidVector)
+		return
+	}
+	for _, f := range vector {
+		if math.IsNaN(float64(f)) || math.IsInf(float64(f), 0) {
+			vem.err = fmt.Errorf("%w: %v", ErrInvalidVector, f)
+			return
+		}
+	}
+	vem.vector = encodeVector(vector)
+}
+
+func encodeVector(vector []float32) []byte {
+	res := make([]byte, 4*len(vector))
+	for i, f := range vector {
+		binary.BigEndian.PutUint32(res[i*4:], math.Float32bits(f))
+	}
+	return res
+}
+
+// checkVectorLength fails if vector, put for document id in view ns, does
+// not have the length of the other vectors of the view; for views without
+// an approximate index, that checks it when a node is inserted.
+func checkVectorLength(txn *badger.Txn, ns, id string, vector []byte) error {
+	prefix := appendSegment([]byte(pat4View(ns+viewx2k)), vectorKey)
+	opt := badger.DefaultIteratorOptions
+	opt.PrefetchValues = false
+	return itrFunc(txn, opt, prefix, prefix, func(itr interface{ Item() *badger.Item }) error {
+		item := itr.Item()
+		if _, other := splitViewKey(item.Key()); string(other) == id {
+			return nil
+		}
+		v, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if len(v) != len(vector) {
+			return fmt.Errorf("%w: length %d, view has %d", ErrInvalidVector, len(vector)/4, len(v)/4)
+		}
+		return errStop
+	})
+}
+
+func decodeVector(v []byte) []float32 {
+	res := make([]float32, len(v)/4)
+	for i := range res {
+		res[i] = math.Float32frombits(binary.BigEndian.Uint32(v[i*4:]))
+	}
+	return res
+}
+
+//-----------------------------------------------------------------------------
+
+// VectorRes is a document found by Nearest(...).
+type VectorRes struct {
+	ID       string
+	Distance float64
+}
+
+// Nearest finds the k documents with the nearest vectors, nearest first.
+// If the view has an approximate index for metric, it is used; otherwise
+// all vectors are compared.
+func (db *DB) Nearest(view string, vector []float32, k int, metric Metric) (reslist []VectorRes, reserr error) {
+	vw, ok := db.views.find(view)
+	if !ok || !vw.vector {
+		return nil, ErrViewNotFound
+	}
+	if vw.vectors == nil || vw.vectors.Metric != metric {
+		return db.NearestExact(view, vector, k, metric)
+	}
+	if k <= 0 {
+		k = 10
+	}
+	reserr = db.view("nearest", func(txn *badger.Txn) error {
+		g := newGraph(txn, vw.ns, vw.vectors)
+		found, err := g.search(vector, k)
+		if err != nil {
+			return err
+		}
+		for _, c := range found {
+			reslist = append(reslist, VectorRes{ID: c.id, Distance: c.dist})
+		}
+		return nil
+	})
+	return
+}
+
+// NearestExact finds the k documents with the nearest vectors, nearest first,
+// comparing all vectors of the view.
+func (db *DB) NearestExact(view string, vector []float32, k int, metric Metric) (reslist []VectorRes, reserr error) {
+	vw, ok := db.views.find(view)
+	if !ok || !vw.vector {
+		return nil, ErrViewNotFound
+	}
+	if k <= 0 {
+		k = 10
+	}
+	var found []candidate
+	reserr = db.view("nearest_exact", func(txn *badger.Txn) error {
+		prefix := appendSegment([]byte(pat4View(vw.ns+viewx2k)), vectorKey)
+		opt := badger.DefaultIteratorOptions
+		return itrFunc(txn, opt, prefix, prefix, func(itr interface{ Item() *badger.Item }) error {
+			item := itr.Item()
+			v, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			other := decodeVector(v)
+			if len(other) != len(vector) {
+				return fmt.Errorf("%w: length %d, view has %d", ErrInvalidVector, len(vector), len(other))
+			}
+			_, id := splitViewKey(item.Key())
+			found = insertCandidate(found, candidate{string(id), metric.distance(vector, other)}, k)
+			return nil
+		})
+	})
+	for _, c := range found {
+		reslist = append(reslist, VectorRes{ID: c.id, Distance: c.dist})
+	}
+	return
+}
+
+type candidate struct {
+	id   string
+	dist float64
+}
+
+// insertCandidate inserts c into a sorted list, keeping at most max items.
+func insertCandidate(list []candidate, c candidate, max int) []candidate {
+	ix := sort.Search(len(list), func(i int) bool {
+		return list[i].dist > c.dist || (list[i].dist == c.dist && list[i].id > c.id)
+	})
+	if ix >= max {
+		return list
+	}
+	list = append(list, candidate{})
+	copy(list[ix+1:], list[ix:])
+	list[ix] = c
+	if len(list) > max {
+		list = list[:max]
+	}
+	return list
+}
+
+//-----------------------------------------------------------------------------
+
+// The graph of the approximate index is kept inside the view namespace:
+//
+//	^NS@e     -> level of the entry node, its id
+//	^NS@n ID  -> neighbors of the node on each of its layers
+//
+// Vectors are read from the view itself.
+const (
+	gphEntry = "e"
+	gphNode  = "n"
+	maxLevel = 16
+)
+
+type graphNode struct {
+	links [][]string
+}
+
+type graph struct {
+	txn     *badger.Txn
+	ns      string
+	ix      *VectorIndex
+	nodes   map[string]*graphNode
+	vectors map[string][]float32
+	dirty   map[string]bool
+
+	// the entry node, read once and written by flush() if it has changed,
+	// so concurrent Puts only conflict when they move it
+	entryRead  bool
+	entryFound bool
+	entryID    string
+	entryLevel int
+	entryOrig  []byte
+}
+
+func newGraph(txn *badger.Txn, ns string, ix *VectorIndex) *graph {
+	return &graph{
+		txn:     txn,
+		ns:      ns,
+		ix:      ix,
+		nodes:   make(map[string]*graphNode),
+		vectors: make(map[string][]float32),
+		dirty:   make(map[string]bool),
+	}
+}
+
+// update puts the current vector of document id into the graph, replacing
+// its previous one, or removes it if the document has no vector anymore.
+func (ix *VectorIndex) update(txn *badger.Txn, ns, id string) error {
+	g := newGraph(txn, ns, ix)
+	wasEntry, _, _, err := g.entry()
+	if err != nil {
+		return err
+	}
+	if err := g.remove(id); err != nil {
+		return err
+	}
+	vec, err := g.vector(id)
+	if err != nil {
+		return err
+	}
+	if vec != nil {
+		if err := g.insert(id, vec); err != nil {
+			return err
+		}
+		// the entry node stays the entry, if it is still on the top layer
+		_, elevel, _, err := g.entry()
+		if err != nil {
+			return err
+		}
+		if level := g.levelOf(id); wasEntry == id && level >= elevel {
+			g.setEntry(id, level)
+		}
+	}
+	return g.flush()
+}
+
+func (g *graph) key(s ...string) []byte {
+	k := pat4View(g.ns + viewgph)
+	for _, p := range s {
+		k += p
+	}
+	return []byte(k)
+}
+
+func (g *graph) entry() (id string, level int, found bool, reserr error) {
+	if !g.entryRead {
+		item, err := g.txn.Get(g.key(gphEntry))
+		switch err {
+		case nil:
+			v, err := item.ValueCopy(nil)
+			if err != nil {
+				return "", 0, false, err
+			}
+			g.entryOrig = v
+			if len(v) > 0 {
+				g.entryID, g.entryLevel, g.entryFound = string(v[1:]), int(v[0]), true
+			}
+		case badger.ErrKeyNotFound:
+		default:
+			return "", 0, false, err
+		}
+		g.entryRead = true
+	}
+	return g.entryID, g.entryLevel, g.entryFound, nil
+}
+
+func (g *graph) setEntry(id string, level int) error {
+	g.entryRead, g.entryFound = true, true
+	g.entryID, g.entryLevel = id, level
+	return nil
+}
+
+func (g *graph) clearEntry() error {
+	g.entryRead, g.entryFound = true, false
+	g.entryID, g.entryLevel = "", 0
+	return nil
+}
+
+func (g *graph) vector(id string) ([]float32, error) {
+	if v, ok := g.vectors[id]; ok {
+		return v, nil
+	}
+	k := append(appendSegment([]byte(pat4View(g.ns+viewx2k)), vectorKey), id...)
+	item, err := g.txn.Get(k)
+	if err == badger.ErrKeyNotFound {
+		g.vectors[id] = nil
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	v, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	g.vectors[id] = decodeVector(v)
+	return g.vectors[id], nil
+}
+
+func (g *graph) node(id string) (*graphNode, error) {
+	if n, ok := g.nodes[id]; ok {
+		return n, nil
+	}
+	item, err := g.txn.Get(g.key(gphNode, id))
+	if err == badger.ErrKeyNotFound {
+		g.nodes[id] = nil
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	v, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	n := &graphNode{}
+	for len(v) > 0 {
+		count, c := binary.Uvarint(v)
+		if c <= 0 || count > uint64(len(v)) {
+			return nil, fmt.Errorf("invalid vector index node %q", id)
+		}
+		v = v[c:]
+		var links []string
+		for i := uint64(0); i < count; i++ {
+			size, c := binary.Uvarint(v)
+			if c <= 0 || size > uint64(len(v)-c) {
+				return nil, fmt.Errorf("invalid vector index node %q", id)
+			}
+			links = append(links, string(v[c:c+int(size)]))
+			v = v[c+int(size):]
+		}
+		n.links = append(n.links, links)
+	}
+	g.nodes[id] = n
+	return n, nil
+}
+
+func (g *graph) flush() error {
+	if g.entryRead {
+		var v []byte
+		if g.entryFound {
+			v = append([]byte{byte(g.entryLevel)}, g.entryID...)
+		}
+		if string(v) != string(g.entryOrig) {
+			var err error
+			if g.entryFound {
+				err = g.txn.Set(g.key(gphEntry), v)
+			} else {
+				err = g.txn.Delete(g.key(gphEntry))
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for id := range g.dirty {
+		n := g.nodes[id]
+		if n == nil {
+			if err := g.txn.Delete(g.key(gphNode, id)); err != nil {
+				return err
+			}
+			continue
+		}
+		var v []byte
+		for _, links := range n.links {
+			v = appendUvarint(v, uint64(len(links)))
+			for _, l := range links {
+				v = appendUvarint(v, uint64(len(l)))
+				v = append(v, l...)
+			}
+		}
+		if err := g.txn.Set(g.key(gphNode, id), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// levelOf picks the top layer of a node, from the hash of its id, so the
+// graph does not depend on a random source.
+func (g *graph) levelOf(id string) int {
+	h := binary.BigEndian.Uint64(fnvhash([]byte(id)))
+	u := (float64(h>>11) + 1) / (1 << 53)
+	level := int(-math.Log(u) / math.Log(float64(g.ix.M)))
+	if level > maxLevel {
+		level = maxLevel
+	}
+	return level
+}
+
+func (g *graph) maxLinks(layer int) int {
+	if layer == 0 {
+		return 2 * g.ix.M
+	}
+	return g.ix.M
+}
+
+func (g *graph) insert(id string, vec []float32) error {
+	level := g.levelOf(id)
+	g.nodes[id] = &graphNode{links: make([][]string, level+1)}
+	g.dirty[id] = true
+	eid, elevel, found, err := g.entry()
+	if err != nil {
+		return err
+	}
+	if !found {
+		return g.setEntry(id, level)
+	}
+	evec, err := g.vector(eid)
+	if err != nil {
+		return err
+	}
+	if len(evec) != len(vec) {
+		return fmt.Errorf("%w: length %d, view has %d", ErrInvalidVector, len(vec), len(evec))
+	}
+	eps := []candidate{{eid, g.ix.Metric.distance(vec, evec)}}
+	for layer := elevel; layer > level; layer-- {
+		if eps, err = g.searchLayer(vec, eps, 1, layer); err != nil {
+			return err
+		}
+	}
+	top := level
+	if elevel < top {
+		top = elevel
+	}
+	for layer := top; layer >= 0; layer-- {
+		if eps, err = g.searchLayer(vec, eps, g.ix.EfConstruction, layer); err != nil {
+			return err
+		}
+		var links []string
+		for _, c := range eps {
+			if len(links) == g.ix.M {
+				break
+			}
+			links = append(links, c.id)
+		}
+		g.nodes[id].links[layer] = links
+		for _, nid := range links {
+			if err := g.connect(nid, layer, id); err != nil {
+				return err
+			}
+		}
+	}
+	if level > elevel {
+		return g.setEntry(id, level)
+	}
+	return nil
+}
+
+// connect adds id to the neighbors of nid on layer, keeping the nearest.
+func (g *graph) connect(nid string, layer int, ids ...string) error {
+	n, err := g.node(nid)
+	if err != nil || n == nil || layer >= len(n.links) {
+		return err
+	}
+	links := n.links[layer]
+	for _, id := range ids {
+		if id == nid || contains(links, id) {
+			continue
+		}
+		links = append(links, id)
+	}
+	if len(links) > g.maxLinks(layer) {
+		nvec, err := g.vector(nid)
+		if err != nil {
+			return err
+		}
+		var best []candidate
+		for _, l := range links {
+			lvec, err := g.vector(l)
+			if err != nil {
+				return err
+			}
+			if lvec == nil {
+				continue
+			}
+			best = insertCandidate(best, candidate{l, g.ix.Metric.distance(nvec, lvec)}, g.maxLinks(layer))
+		}
+		links = links[:0]
+		for _, c := range best {
+			links = append(links, c.id)
+		}
+	}
+	n.links[layer] = links
+	g.dirty[nid] = true
+	return nil
+}
+
+// remove takes node id out of the graph; its neighbors are connected to its
+// other neighbors instead.
+func (g *graph) remove(id string) error {
+	n, err := g.node(id)
+	if err != nil || n == nil {
+		return err
+	}
+	g.nodes[id] = nil
+	g.dirty[id] = true
+	for layer, links := range n.links {
+		for _, nid := range links {
+			nn, err := g.node(nid)
+			if err != nil {
+				return err
+			}
+			if nn == nil || layer >= len(nn.links) {
+				continue
+			}
+			nn.links[layer] = without(nn.links[layer], id)
+			g.dirty[nid] = true
+			if err := g.connect(nid, layer, links...); err != nil {
+				return err
+			}
+		}
+	}
+	eid, _, _, err := g.entry()
+	if err != nil || eid != id {
+		return err
+	}
+	// a new entry: a neighbor on the highest layer, or any node with
+	// the highest level
+	for layer := len(n.links) - 1; layer >= 0; layer-- {
+		if len(n.links[layer]) > 0 {
+			nid := n.links[layer][0]
+			nn, err := g.node(nid)
+			if err != nil || nn == nil {
+				return err
+			}
+			return g.setEntry(nid, len(nn.links)-1)
+		}
+	}
+	newID, newLevel := "", -1
+	prefix := g.key(gphNode)
+	opt := badger.DefaultIteratorOptions
+	opt.PrefetchValues = false
+	err = itrFunc(g.txn, opt, prefix, prefix, func(itr interface{ Item() *badger.Item }) error {
+		nid := string(itr.Item().Key()[len(prefix):])
+		if nid == id {
+			return nil
+		}
+		nn, err := g.node(nid)
+		if err != nil || nn == nil {
+			return err
+		}
+		if len(nn.links)-1 > newLevel {
+			newID, newLevel = nid, len(nn.links)-1
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if newLevel < 0 {
+		return g.clearEntry()
+	}
+	return g.setEntry(newID, newLevel)
+}
+
+// searchLayer finds the ef nearest nodes to vec on layer, starting from eps.
+func (g *graph) searchLayer(vec []float32, eps []candidate, ef, layer int) (resfound []candidate, reserr error) {
+	visited := make(map[string]bool)
+	var cands []candidate
+	for _, c := range eps {
+		visited[c.id] = true
+		cands = insertCandidate(cands, c, len(eps))
+		resfound = insertCandidate(resfound, c, ef)
+	}
+	for len(cands) > 0 {
+		c := cands[0]
+		cands = cands[1:]
+		if len(resfound) >= ef && c.dist > resfound[len(resfound)-1].dist {
+			break
+		}
+		n, err := g.node(c.id)
+		if err != nil {
+			return nil, err
+		}
+		if n == nil || layer >= len(n.links) {
+			continue
+		}
+		for _, nid := range n.links[layer] {
+			if visited[nid] {
+				continue
+			}
+			visited[nid] = true
+			nvec, err := g.vector(nid)
+			if err != nil {
+				return nil, err
+			}
+			if nvec == nil || len(nvec) != len(vec) {
+				continue
+			}
+			d := g.ix.Metric.distance(vec, nvec)
+			if len(resfound) < ef || d < resfound[len(resfound)-1].dist {
+				cands = insertCandidate(cands, candidate{nid, d}, math.MaxInt32)
+				resfound = insertCandidate(resfound, candidate{nid, d}, ef)
+			}
+		}
+	}
+	return
+}
+
+func (g *graph) search(vec []float32, k int) ([]candidate, error) {
+	eid, elevel, found, err := g.entry()
+	if err != nil || !found {
+		return nil, err
+	}
+	evec, err := g.vector(eid)
+	if err != nil {
+		return nil, err
+	}
+	if len(evec) != len(vec) {
+		return nil, fmt.Errorf("%w: length %d, view has %d", ErrInvalidVector, len(vec), len(evec))
+	}
+	eps := []candidate{{eid, g.ix.Metric.distance(vec, evec)}}
+	for layer := elevel; layer > 0; layer-- {
+		if eps, err = g.searchLayer(vec, eps, 1, layer); err != nil {
+			return nil, err
+		}
+	}
+	ef := g.ix.EfSearch
+	if ef < k {
+		ef = k
+	}
+	if eps, err = g.searchLayer(vec, eps, ef, 0); err != nil {
+		return nil, err
+	}
+	if len(eps) > k {
+		eps = eps[:k]
+	}
+	return eps, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func without(list []string, s string) []string {
+	res := list[:0:0]
+	for _, v := range list {
+		if v != s {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+//-----------------------------------------------------------------------------
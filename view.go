@@ -1,12 +1,19 @@
 package dockage
 
-import "github.com/dgraph-io/badger"
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
 
 //-----------------------------------------------------------------------------
 
 type idd struct {
 	ID  string
 	Doc interface{}
+	JS  []byte
 }
 
 // ViewFn function that emits view keys (and json docs as view values).
@@ -16,7 +23,25 @@ type ViewFn func(emitter Emitter, id string, doc interface{})
 type View struct {
 	name   string
 	viewFn func(emitter Emitter, id string, doc interface{}) (inf interface{}, err error)
-	hash   string
+	// ns is the namespace of the view, its id in the view catalog. It is
+	// set by AddView(...).
+	ns string
+
+	// jsonDoc views get the stored json of the document (json.RawMessage)
+	// instead of the document passed to Put.
+	jsonDoc bool
+	// unique views allow each emitted key to be owned by only one document.
+	unique bool
+	// paths of a field view; Find(...) uses them to pick a view.
+	paths []string
+	// text views keep the number and total length of indexed documents.
+	text     bool
+	analyzer Analyzer
+	// geo views store locations, see NewGeoView.
+	geo bool
+	// vectors is the approximate index of a vector view, if any.
+	vectors *VectorIndex
+	vector  bool
 }
 
 // NewView creates a new View. Function viewFn must have no side effects.
@@ -35,6 +60,16 @@ func NewView(name string, viewFn ViewFn) (resview View) {
 	return
 }
 
+// NewUniqueView creates a View whose emitted keys may only be owned by one
+// document. If a document emits a key that is already emitted by another
+// document, Put(...) fails with a *UniqueViolation. Deleting the document,
+// or putting it without emitting the key, frees the key.
+func NewUniqueView(name string, viewFn ViewFn) (resview View) {
+	resview = NewView(name, viewFn)
+	resview.unique = true
+	return
+}
+
 func newView(
 	name string,
 	viewFn func(emitter Emitter, id string, doc interface{}) (inf interface{}, err error)) (resview View) {
@@ -42,7 +77,6 @@ func newView(
 		name:   name,
 		viewFn: viewFn,
 	}
-	resview.hash = string(fnvhash([]byte(resview.name)))
 	return
 }
 
@@ -68,31 +102,66 @@ func (em *viewEmitter) Emit(viewKey, viewValue []byte) {
 }
 
 func (em *viewEmitter) build(id string, doc interface{}) (resinf interface{}, reserr error) {
-	partk2x := pat4View(em.v.hash + viewk2x)
-	partx2k := pat4View(em.v.hash + viewx2k)
+	if reserr = em.txn.ctx.Err(); reserr != nil {
+		return
+	}
+	partx2k := []byte(pat4View(em.v.ns + viewx2k))
+	preppedk := k2xPrefix(em.v.ns, id)
+
+	if em.txn.obs != nil && em.v.ns != sqNS {
+		defer func(start time.Time) { em.txn.obs.ViewBuilt(em.v.name, time.Since(start)) }(time.Now())
+	}
 
-	markedKey := pat4View(id)
-	preppedk := partk2x + markedKey
+	// changes to the number and total length of documents of a text view
+	var docs, length int64
+	if em.v.text {
+		defer func() {
+			if reserr == nil && (docs != 0 || length != 0) {
+				em.txn.countText(em.v.ns, docs, length)
+			}
+		}()
+	}
+
+	// the approximate index of a vector view follows the stored vectors
+	if em.v.vectors != nil {
+		defer func() {
+			if reserr == nil {
+				reserr = em.v.vectors.update(em.txn.tx, em.v.ns, id)
+			}
+		}()
+	}
 
 	opt := badger.DefaultIteratorOptions
 	opt.PrefetchValues = false
 
 	// delete previously calculated index for this key
 	txn := em.txn.tx
-	itr := txn.NewIterator(opt)
-	defer itr.Close()
-	prefix := []byte(preppedk)
+	prefix := preppedk
 	var toDelete [][]byte
-	for itr.Seek(prefix); itr.ValidForPrefix(prefix); itr.Next() {
+	reserr = itrFuncContext(em.txn.ctx, txn, opt, prefix, prefix, func(itr interface{ Item() *badger.Item }) error {
 		item := itr.Item()
 		k := item.KeyCopy(nil)
 		v, err := item.ValueCopy(nil)
 		if err != nil {
-			reserr = err
-			return
+			return err
 		}
 		toDelete = append(toDelete, k)
 		toDelete = append(toDelete, v)
+		em.txn.count(em.v.ns, -1, -entrySize(k, v))
+		if em.v.unique {
+			toDelete = append(toDelete, ownerKey(em.v.ns, k[len(prefix):]))
+		}
+		if em.v.text && len(k) == len(prefix) {
+			dl, err := docLength(txn, v)
+			if err != nil {
+				return err
+			}
+			docs, length = docs-1, length-dl
+		}
+		return nil
+	})
+	if reserr != nil {
+		return
 	}
 	for _, v := range toDelete {
 		if err := txn.Delete(v); err != nil {
@@ -112,29 +181,97 @@ func (em *viewEmitter) build(id string, doc interface{}) (resinf interface{}, re
 		return
 	}
 
+	added := make(map[string]bool, len(em.emitted))
 	for _, kv := range em.emitted {
-		wix := pat4View(string(kv.Key))
-		k2x := preppedk + wix
-		x2k := partx2k + wix + markedKey
-		if reserr = txn.Set([]byte(k2x), []byte(x2k)); reserr != nil {
+		if em.v.unique {
+			if reserr = em.own(id, kv.Key); reserr != nil {
+				return
+			}
+		}
+		if em.v.vector && em.v.vectors == nil {
+			if reserr = checkVectorLength(txn, em.v.ns, id, kv.Val); reserr != nil {
+				return
+			}
+		}
+		k2x := append(preppedk[:len(preppedk):len(preppedk)], kv.Key...)
+		x2k := append(appendSegment(partx2k[:len(partx2k):len(partx2k)], kv.Key), id...)
+		if reserr = txn.Set(k2x, x2k); reserr != nil {
 			return
 		}
-		if reserr = txn.Set([]byte(x2k), kv.Val); reserr != nil {
+		if reserr = txn.Set(x2k, kv.Val); reserr != nil {
 			return
 		}
+		if !added[string(k2x)] {
+			added[string(k2x)] = true
+			em.txn.count(em.v.ns, 1, entrySize(k2x, x2k))
+		}
+		if em.v.text && len(kv.Key) == 0 {
+			dl, _ := binary.Uvarint(kv.Val)
+			docs, length = docs+1, length+int64(dl)
+		}
 	}
 
 	return
 }
 
+// own makes document id the owner of viewKey, in a unique view.
+func (em *viewEmitter) own(id string, viewKey []byte) error {
+	txn := em.txn.tx
+	k := ownerKey(em.v.ns, viewKey)
+	item, err := txn.Get(k)
+	switch err {
+	case nil:
+		owner, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if string(owner) != id {
+			return &UniqueViolation{
+				View:  em.v.name,
+				Key:   append([]byte{}, viewKey...),
+				ID:    id,
+				Owner: string(owner),
+			}
+		}
+		return nil
+	case badger.ErrKeyNotFound:
+		return txn.Set(k, []byte(id))
+	}
+	return err
+}
+
+// ownerKey is the key that holds the id of the document owning viewKey,
+// in a unique view.
+func ownerKey(ns string, viewKey []byte) []byte {
+	return append([]byte(pat4View(ns+viewk2o)), viewKey...)
+}
+
+// k2xPrefix is the prefix of all view keys emitted for a document.
+func k2xPrefix(ns, id string) []byte {
+	return appendSegment([]byte(pat4View(ns+viewk2x)), []byte(id))
+}
+
 //-----------------------------------------------------------------------------
 
 type views []View
 
-func (vl views) buildAll(tx *transaction, id string, doc interface{}) (resinf interface{}, reserr error) {
+func (vl views) find(name string) (View, bool) {
+	for _, v := range vl {
+		if v.name == name {
+			return v, true
+		}
+	}
+	return View{}, false
+}
+
+func (vl views) buildAll(tx *transaction, id string, doc interface{}, js []byte) (resinf interface{}, reserr error) {
 	for _, ix := range vl {
 		em := newViewEmitter(tx, ix)
-		resinf, reserr = em.build(id, doc)
+		vdoc := doc
+		if ix.jsonDoc && doc != nil {
+			vdoc = json.RawMessage(js)
+		}
+		resinf, reserr = em.build(id, vdoc)
 		if reserr != nil {
 			return
 		}